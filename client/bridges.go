@@ -0,0 +1,146 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sote/db"
+	"strconv"
+	"strings"
+
+	"github.com/urfave/cli/v2"
+)
+
+// bridgesCommand manages the bridge lines the node applies to every account's tor
+var bridgesCommand = &cli.Command{
+	Name:  "bridges",
+	Usage: "Manage tor bridges for censored networks",
+	Subcommands: []*cli.Command{
+		{
+			Name:      "add",
+			Usage:     "Add bridge lines",
+			ArgsUsage: "[bridge line]",
+			Flags: []cli.Flag{
+				&cli.StringFlag{
+					Name:  "file",
+					Usage: "Import bridge lines from a file, one per line",
+				},
+				&cli.StringFlag{
+					Name:  "qr",
+					Usage: "Import the payload of a scanned BridgeDB QR code",
+				},
+			},
+			Action: addBridges,
+		},
+		{
+			Name:   "list",
+			Usage:  "List the stored bridges",
+			Action: listBridges,
+		},
+		{
+			Name:      "remove",
+			Usage:     "Remove a bridge by its id",
+			ArgsUsage: "<id>",
+			Action:    removeBridge,
+		},
+		{
+			Name:      "plugin",
+			Usage:     "Set the pluggable transport client (ClientTransportPlugin), empty to detect lyrebird or obfs4proxy",
+			ArgsUsage: "[path]",
+			Action:    setTransportPlugin,
+		},
+	},
+}
+
+func addBridges(c *cli.Context) error {
+	var text string
+	switch {
+	case c.String("file") != "":
+		content, err := os.ReadFile(c.String("file"))
+		if err != nil {
+			return err
+		}
+		text = string(content)
+	case c.String("qr") != "":
+		text = c.String("qr")
+	case c.Args().Present():
+		text = strings.Join(c.Args().Slice(), " ")
+	default:
+		return errors.New("give a bridge line, --file or --qr")
+	}
+
+	// The node keeps the bridges, the client never opens its database
+	if err := loadSession(); err != nil {
+		return err
+	}
+	var result struct {
+		Added []string `json:"added"`
+	}
+	if err := postNodeRequest("/add-bridges", map[string]string{"bridges": text}, &result); err != nil {
+		return cli.Exit(err, exitFailure)
+	}
+	for _, line := range result.Added {
+		fmt.Println("Bridge added:", line)
+	}
+	fmt.Println("Bridges are used the next time an account's tor starts")
+	return nil
+}
+
+func listBridges(c *cli.Context) error {
+	if err := loadSession(); err != nil {
+		return err
+	}
+	var result struct {
+		Bridges         []db.Bridge `json:"bridges"`
+		TransportPlugin string      `json:"transportPlugin"`
+		Detected        bool        `json:"detected"`
+	}
+	if err := postNodeRequest("/bridges", nil, &result); err != nil {
+		return cli.Exit(err, exitFailure)
+	}
+	if len(result.Bridges) == 0 {
+		fmt.Println("No bridges configured.")
+		return nil
+	}
+	for _, bridge := range result.Bridges {
+		fmt.Printf("%d: %s\n", bridge.ID, bridge.Line)
+	}
+
+	plugin := result.TransportPlugin
+	if plugin == "" {
+		plugin = "none found"
+	} else if result.Detected {
+		plugin += " (detected)"
+	}
+	fmt.Println("ClientTransportPlugin:", plugin)
+	return nil
+}
+
+func removeBridge(c *cli.Context) error {
+	id := c.Args().First()
+	if _, err := strconv.Atoi(id); err != nil {
+		return fmt.Errorf("invalid bridge id %q", id)
+	}
+	if err := loadSession(); err != nil {
+		return err
+	}
+	var result map[string]int
+	if err := postNodeRequest("/remove-bridge", map[string]string{"id": id}, &result); err != nil {
+		return cli.Exit(err, exitFailure)
+	}
+	fmt.Println("Bridge removed")
+	return nil
+}
+
+func setTransportPlugin(c *cli.Context) error {
+	if err := loadSession(); err != nil {
+		return err
+	}
+	// The node checks the path, tor runs next to it
+	var result map[string]string
+	if err := postNodeRequest("/transport-plugin", map[string]string{"path": c.Args().First()}, &result); err != nil {
+		return cli.Exit(err, exitFailure)
+	}
+	fmt.Println("ClientTransportPlugin set")
+	return nil
+}
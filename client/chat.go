@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// nodeEvent is an event the node pushes on /events
+type nodeEvent struct {
+	Type string          `json:"type"`
+	Data json.RawMessage `json:"data"`
+}
+
+// Data of the node's event types
+type (
+	messageEventData struct {
+		ID       string `json:"id"`
+		Sender   string `json:"sender"`
+		Receiver string `json:"receiver"`
+		Message  string `json:"message"`
+		SentAt   int64  `json:"sentAt"`
+		Seq      int    `json:"seq"`
+		Group    string `json:"group"`
+	}
+	contactEventData struct {
+		Username     string `json:"username"`
+		Nickname     string `json:"nickname"`
+		OnionAddress string `json:"onionAddress"`
+	}
+	deliveryEventData struct {
+		ID       string `json:"id"`
+		Receiver string `json:"receiver"`
+		Contact  string `json:"contact"`
+		State    string `json:"state"`
+	}
+	receiptEventData struct {
+		Contact string   `json:"contact"`
+		Kind    string   `json:"kind"`
+		IDs     []string `json:"ids"`
+		At      int64    `json:"at"`
+	}
+)
+
+// streamEvents reads the node's event stream and calls handle for every event until ctx is done
+func streamEvents(ctx context.Context, handle func(nodeEvent)) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, nodeURL+"/events", nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+sessionToken)
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to open event stream: %s", resp.Status)
+	}
+
+	// Server-sent events, only the data lines matter, they carry the event type too
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 64*1024), 1<<20)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, "data: ") {
+			continue
+		}
+		var ev nodeEvent
+		if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &ev); err != nil {
+			continue
+		}
+		handle(ev)
+	}
+	if ctx.Err() != nil {
+		return nil
+	}
+	return scanner.Err()
+}
+
+// markRead tells the node the conversation with a contact was shown
+func markRead(contactNickname string) error {
+	jsonData, err := json.Marshal(map[string]string{"contact": contactNickname})
+	if err != nil {
+		return err
+	}
+	resp, err := postToNode("/mark-read", jsonData)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// chat shows the conversation with a contact and prints new messages as they arrive
+func chat() error {
+	contacts, err := getContacts()
+	if err != nil {
+		return err
+	}
+	if len(contacts) == 0 {
+		fmt.Println("No contacts available.")
+		return nil
+	}
+
+	reader := bufio.NewReader(os.Stdin)
+	fmt.Print("Enter the number of the contact: ")
+	choiceStr, _ := reader.ReadString('\n')
+	choice, err := strconv.Atoi(strings.TrimSpace(choiceStr))
+	if err != nil || choice < 1 || choice > len(contacts) {
+		fmt.Println("Invalid choice")
+		return nil
+	}
+	contact := contacts[choice-1]
+
+	if err := showConversation(contact.Nickname); err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		err := streamEvents(ctx, func(ev nodeEvent) {
+			printChatEvent(contact.Nickname, ev)
+		})
+		if err != nil {
+			fmt.Println("Event stream closed:", err)
+		}
+	}()
+
+	fmt.Printf("Chatting with %s, type a message and press enter, /quit to leave\n", contact.Nickname)
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return nil
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		if line == "/quit" {
+			return nil
+		}
+		if _, err := postMessage(contact.Nickname, line); err != nil {
+			fmt.Println("Failed to send message:", err)
+		}
+	}
+}
+
+// printChatEvent prints an event of the node in chat mode with contactNickname
+func printChatEvent(contactNickname string, ev nodeEvent) {
+	switch ev.Type {
+	case "message":
+		var data messageEventData
+		if json.Unmarshal(ev.Data, &data) != nil {
+			return
+		}
+		if data.Group != "" {
+			fmt.Printf("* New group message from %s\n", data.Sender)
+			return
+		}
+		if data.Sender != contactNickname {
+			fmt.Printf("* New message from %s\n", data.Sender)
+			return
+		}
+		fmt.Printf("[%s] %s: %s\n", formatTime(data.SentAt), data.Sender, data.Message)
+		if err := markRead(contactNickname); err != nil {
+			fmt.Println("Failed to mark message read:", err)
+		}
+	case "delivery":
+		var data deliveryEventData
+		if json.Unmarshal(ev.Data, &data) != nil || data.Contact != contactNickname {
+			return
+		}
+		fmt.Printf("* Message %s %s\n", shortID(data.ID), data.State)
+	case "receipt":
+		var data receiptEventData
+		if json.Unmarshal(ev.Data, &data) != nil || data.Contact != contactNickname {
+			return
+		}
+		for _, id := range data.IDs {
+			fmt.Printf("* Message %s %s by %s\n", shortID(id), data.Kind, data.Contact)
+		}
+	case "contact-request":
+		var data contactEventData
+		if json.Unmarshal(ev.Data, &data) != nil {
+			return
+		}
+		fmt.Printf("* Contact request from %s, answer it from the main menu\n", data.Username)
+	case "contact":
+		var data contactEventData
+		if json.Unmarshal(ev.Data, &data) != nil {
+			return
+		}
+		fmt.Printf("* %s accepted your contact request, saved as %s\n", data.Username, data.Nickname)
+	}
+}
+
+// shortID shortens a message ID for display
+func shortID(id string) string {
+	if len(id) > 8 {
+		return id[:8]
+	}
+	return id
+}
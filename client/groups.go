@@ -0,0 +1,313 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sote/db"
+	"strings"
+
+	"github.com/urfave/cli/v2"
+)
+
+// groupFlag names a group by its ID or its name
+var groupFlag = &cli.StringFlag{
+	Name:     "group",
+	Usage:    "ID or name of the group",
+	Required: true,
+}
+
+// groupsCommand manages group conversations, only the creator of a group changes its members
+var groupsCommand = &cli.Command{
+	Name:  "groups",
+	Usage: "Create groups, invite contacts and talk to them",
+	Subcommands: []*cli.Command{
+		{
+			Name:   "list",
+			Usage:  "List your groups and their members",
+			Flags:  []cli.Flag{jsonFlag},
+			Action: listGroupsCommand,
+		},
+		{
+			Name:      "create",
+			Usage:     "Create a group with you as its only member",
+			ArgsUsage: "<name>",
+			Flags:     []cli.Flag{jsonFlag},
+			Action:    createGroupCommand,
+		},
+		{
+			Name:      "invite",
+			Usage:     "Add a contact to a group you created",
+			ArgsUsage: "<contact>",
+			Flags:     []cli.Flag{jsonFlag, groupFlag},
+			Action:    inviteToGroupCommand,
+		},
+		{
+			Name:      "remove",
+			Usage:     "Remove a member from a group you created",
+			ArgsUsage: "<member>",
+			Flags:     []cli.Flag{jsonFlag, groupFlag},
+			Action:    removeFromGroupCommand,
+		},
+		{
+			Name:      "send",
+			Usage:     "Send a message to every member of a group, - reads it from stdin",
+			ArgsUsage: "<text|->",
+			Flags:     []cli.Flag{jsonFlag, groupFlag},
+			Action:    sendGroupMessageCommand,
+		},
+		{
+			Name:   "messages",
+			Usage:  "Print the conversation of a group",
+			Flags:  []cli.Flag{jsonFlag, groupFlag},
+			Action: groupMessagesCommand,
+		},
+	},
+}
+
+func listGroupsCommand(c *cli.Context) error {
+	if err := loadSession(); err != nil {
+		return err
+	}
+	groups, err := fetchGroups()
+	if err != nil {
+		return cli.Exit(err, exitFailure)
+	}
+
+	var lines []string
+	for _, group := range groups {
+		lines = append(lines, groupLine(group))
+	}
+	return printResult(c, groupsOutput(groups), strings.Join(lines, "\n"))
+}
+
+func createGroupCommand(c *cli.Context) error {
+	name := strings.TrimSpace(strings.Join(c.Args().Slice(), " "))
+	if name == "" {
+		return cli.Exit("give the name of the group", exitUsage)
+	}
+	if err := loadSession(); err != nil {
+		return err
+	}
+
+	var group db.Group
+	if err := postNodeRequest("/create-group", map[string]string{"name": name}, &group); err != nil {
+		return cli.Exit(err, exitFailure)
+	}
+	return printResult(c, groupsOutput([]db.Group{group})[0], "Created "+groupLine(group))
+}
+
+func inviteToGroupCommand(c *cli.Context) error {
+	if c.NArg() != 1 {
+		return cli.Exit("give the nickname or fingerprint of the contact", exitUsage)
+	}
+	if err := loadSession(); err != nil {
+		return err
+	}
+	groupID, err := resolveGroup(c.String("group"))
+	if err != nil {
+		return err
+	}
+	contactNickname, err := contactName(c.Args().First())
+	if err != nil {
+		return err
+	}
+
+	var group db.Group
+	if err := postNodeRequest("/invite-to-group", map[string]string{"group": groupID, "contact": contactNickname}, &group); err != nil {
+		return cli.Exit(err, exitFailure)
+	}
+	return printResult(c, groupsOutput([]db.Group{group})[0], groupLine(group))
+}
+
+func removeFromGroupCommand(c *cli.Context) error {
+	if c.NArg() != 1 {
+		return cli.Exit("give the username or .onion address of the member", exitUsage)
+	}
+	if err := loadSession(); err != nil {
+		return err
+	}
+	groupID, err := resolveGroup(c.String("group"))
+	if err != nil {
+		return err
+	}
+
+	var group db.Group
+	if err := postNodeRequest("/remove-from-group", map[string]string{"group": groupID, "member": c.Args().First()}, &group); err != nil {
+		return cli.Exit(err, exitFailure)
+	}
+	return printResult(c, groupsOutput([]db.Group{group})[0], groupLine(group))
+}
+
+func sendGroupMessageCommand(c *cli.Context) error {
+	if c.NArg() == 0 {
+		return cli.Exit("give the message, or - to read it from stdin", exitUsage)
+	}
+	message := strings.Join(c.Args().Slice(), " ")
+	if message == "-" {
+		data, err := io.ReadAll(os.Stdin)
+		if err != nil {
+			return cli.Exit(err, exitFailure)
+		}
+		message = strings.TrimRight(string(data), "\n")
+	}
+	if message == "" {
+		return cli.Exit("the message is empty", exitUsage)
+	}
+
+	if err := loadSession(); err != nil {
+		return err
+	}
+	groupID, err := resolveGroup(c.String("group"))
+	if err != nil {
+		return err
+	}
+
+	var sent sentMessage
+	if err := postNodeRequest("/send-group-message", map[string]string{"group": groupID, "message": message}, &sent); err != nil {
+		return cli.Exit(err, exitFailure)
+	}
+	return printResult(c, sent, fmt.Sprintf("Message %s %s", sent.ID, sent.State))
+}
+
+func groupMessagesCommand(c *cli.Context) error {
+	if err := loadSession(); err != nil {
+		return err
+	}
+	groupID, err := resolveGroup(c.String("group"))
+	if err != nil {
+		return err
+	}
+
+	var messages []db.Message
+	if err := postNodeRequest("/fetch-group-messages", map[string]string{"group": groupID}, &messages); err != nil {
+		return cli.Exit(err, exitFailure)
+	}
+
+	type messageOutput struct {
+		ID       string `json:"id"`
+		Sender   string `json:"sender"`
+		Message  string `json:"message"`
+		SentAt   int64  `json:"sentAt"`
+		Seq      int    `json:"seq"`
+		Verified bool   `json:"verified"`
+		State    string `json:"state,omitempty"`
+	}
+	output := []messageOutput{}
+	for _, msg := range messages {
+		output = append(output, messageOutput{
+			ID:       msg.UUID,
+			Sender:   msg.Sender,
+			Message:  string(msg.Message),
+			SentAt:   msg.SentAt,
+			Seq:      msg.Seq,
+			Verified: msg.Verified,
+			State:    msg.State,
+		})
+	}
+	return printResult(c, output, strings.Join(conversationLines(messages), "\n"))
+}
+
+// fetchGroups returns the account's groups
+func fetchGroups() ([]db.Group, error) {
+	var groups []db.Group
+	err := postNodeRequest("/groups", nil, &groups)
+	return groups, err
+}
+
+// resolveGroup finds the ID of a group given by ID or name
+func resolveGroup(nameOrID string) (string, error) {
+	groups, err := fetchGroups()
+	if err != nil {
+		return "", cli.Exit(err, exitFailure)
+	}
+	var matches []db.Group
+	for _, group := range groups {
+		if group.GroupID == nameOrID {
+			return group.GroupID, nil
+		}
+		if group.Name == nameOrID {
+			matches = append(matches, group)
+		}
+	}
+	switch len(matches) {
+	case 0:
+		return "", cli.Exit("no group named "+nameOrID, exitNotFound)
+	case 1:
+		return matches[0].GroupID, nil
+	}
+	return "", cli.Exit("several groups are named "+nameOrID+", use the group's ID", exitUsage)
+}
+
+// contactName returns the nickname of the logged-in account's contact with a nickname or fingerprint
+func contactName(nicknameOrFingerprint string) (string, error) {
+	contacts, err := fetchContacts()
+	if err != nil {
+		return "", cli.Exit(err, exitFailure)
+	}
+	for _, contact := range contacts {
+		if contact.Nickname == nicknameOrFingerprint || strings.EqualFold(contact.Fingerprint, nicknameOrFingerprint) {
+			return contact.Nickname, nil
+		}
+	}
+	return "", cli.Exit("no contact named "+nicknameOrFingerprint, exitNotFound)
+}
+
+// postNodeRequest posts a request to one of the node's endpoints and decodes the answer into result
+func postNodeRequest(path string, data map[string]string, result interface{}) error {
+	var jsonData []byte
+	if data != nil {
+		var err error
+		if jsonData, err = json.Marshal(data); err != nil {
+			return err
+		}
+	}
+	resp, err := postToNode(path, jsonData)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	return json.NewDecoder(resp.Body).Decode(result)
+}
+
+// groupLine describes a group in one line
+func groupLine(group db.Group) string {
+	var members []string
+	for _, member := range group.Members {
+		members = append(members, member.Username)
+	}
+	return fmt.Sprintf("%s\t%s\t%s", group.GroupID, group.Name, strings.Join(members, ", "))
+}
+
+// groupOutput is a group as --json prints it
+type groupOutput struct {
+	ID      string              `json:"id"`
+	Name    string              `json:"name"`
+	Creator string              `json:"creator"`
+	Version int                 `json:"version"`
+	Members []groupMemberOutput `json:"members"`
+}
+
+type groupMemberOutput struct {
+	Username     string `json:"username"`
+	OnionAddress string `json:"onionAddress"`
+}
+
+func groupsOutput(groups []db.Group) []groupOutput {
+	output := []groupOutput{}
+	for _, group := range groups {
+		g := groupOutput{ID: group.GroupID, Name: group.Name, Creator: group.CreatorOnionAddress, Version: group.Version, Members: []groupMemberOutput{}}
+		for _, member := range group.Members {
+			g.Members = append(g.Members, groupMemberOutput{Username: member.Username, OnionAddress: member.OnionAddress})
+		}
+		output = append(output, g)
+	}
+	return output
+}
@@ -4,7 +4,6 @@ import (
 	"bufio"
 	"bytes"
 	"context"
-	"crypto/tls"
 	"encoding/json"
 	"fmt"
 	"log"
@@ -18,21 +17,42 @@ import (
 	"syscall"
 	"time"
 
-	"github.com/cretz/bine/tor"
 	"github.com/mdp/qrterminal/v3"
 	"github.com/urfave/cli/v2"
 	"golang.org/x/term"
 )
 
-var currentUser *user.User
-var torInstance *tor.Tor
+var currentUser *user.Profile
+var sessionToken string
 var version string = "SOTE_Alpha_v1.0"
+var socketPath string = "sote.sock"
+
+// client talks to the local node over its unix socket
 var client = &http.Client{
 	Transport: &http.Transport{
-		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", socketPath)
+		},
 	},
 }
 
+// nodeURL is only used to build request paths, the host part is ignored by the socket dialer
+const nodeURL = "http://sote-node"
+
+// postToNode sends a JSON request to the local node with the session token attached
+func postToNode(path string, jsonData []byte) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodPost, nodeURL+path, bytes.NewBuffer(jsonData))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if sessionToken != "" {
+		req.Header.Set("Authorization", "Bearer "+sessionToken)
+	}
+	return client.Do(req)
+}
+
 func main() {
 	app := &cli.App{
 		Name:  "SOTE Client",
@@ -46,33 +66,35 @@ func main() {
 					return nil
 				},
 			},
+			&cli.StringFlag{
+				Name:        "socket",
+				Usage:       "Path of the node's unix socket",
+				Value:       socketPath,
+				EnvVars:     []string{"SOTE_SOCKET"},
+				Destination: &socketPath,
+			},
+			&cli.StringFlag{
+				Name:        "session",
+				Usage:       "Path of the session file the scriptable commands share",
+				Value:       sessionPath,
+				EnvVars:     []string{"SOTE_SESSION"},
+				Destination: &sessionPath,
+			},
 		},
-		Commands: []*cli.Command{
+		Commands: append([]*cli.Command{
 			{
 				Name:   "start",
 				Usage:  "Start the client",
 				Action: startClient,
 			},
-		},
-		Before: func(c *cli.Context) error {
-			// Set the TOR_SOCKS_PORT environment variable
-			os.Setenv("TOR_SOCKS_PORT", "9060")
-
-			// Start Tor service
-			var err error
-			torInstance, err = tor.Start(context.TODO(), nil)
-			if err != nil {
-				return err
-			}
-			db.Initialize()
-			return nil
-		},
-		After: func(c *cli.Context) error {
-			if torInstance != nil {
-				return torInstance.Close()
-			}
-			return nil
-		},
+			{
+				Name:   "tui",
+				Usage:  "Start the full-screen chat client",
+				Action: tuiCommand,
+			},
+			bridgesCommand,
+			groupsCommand,
+		}, scriptCommands...),
 	}
 
 	err := app.Run(os.Args)
@@ -128,32 +150,41 @@ func registerUser() error {
 		fmt.Printf("\nYou entered different passwords. Please try again.\n")
 		return registerUser()
 	}
-	// Send registration request to the node
+	fmt.Printf("\nSending registration request...\n") // Debug print
+	if _, err := register(username, password); err != nil {
+		log.Fatal(err)
+	}
+
+	fmt.Println("User registered successfully")
+	return loginUser()
+}
+
+// register creates an account on the node and returns its public profile
+func register(username, password string) (*user.Profile, error) {
 	userData := map[string]string{
 		"username": username,
 		"password": password,
 	}
 	jsonData, err := json.Marshal(userData)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
 
-	fmt.Printf("\nSending registration request...\n") // Debug print
-
-	url := "https://localhost:18080/register"
-
-	resp, err := client.Post(url, "application/json", bytes.NewBuffer(jsonData))
+	resp, err := postToNode("/register", jsonData)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusCreated {
-		log.Fatalf("Failed to register user: %s", resp.Status)
+		return nil, fmt.Errorf("failed to register user: %s", resp.Status)
 	}
 
-	fmt.Println("User registered successfully")
-	return loginUser()
+	var profile user.Profile
+	if err := json.NewDecoder(resp.Body).Decode(&profile); err != nil {
+		return nil, err
+	}
+	return &profile, nil
 }
 
 func loginUser() error {
@@ -171,52 +202,59 @@ func loginUser() error {
 	password := string(bytePassword)
 	password = strings.TrimSpace(string(password))
 
-	// Send login request to the node
+	if err := login(username, password); err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("\nUser logged in: %s\n", currentUser.Username)
+	return nil
+}
+
+// login logs in at the node and keeps the session token and the public profile
+func login(username, password string) error {
 	userData := map[string]string{
 		"username": username,
 		"password": password,
 	}
 	jsonData, err := json.Marshal(userData)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
 
-	resp, err := client.Post(("https://localhost:18080/login"), "application/json", bytes.NewBuffer(jsonData))
+	resp, err := postToNode("/login", jsonData)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		log.Fatalf("Failed to login: %s", resp.Status)
+		return fmt.Errorf("failed to login: %s", resp.Status)
 	}
 
-	if err := json.NewDecoder(resp.Body).Decode(&currentUser); err != nil {
-		log.Fatal(err)
+	var loginResponse struct {
+		SessionToken string        `json:"sessionToken"`
+		User         *user.Profile `json:"user"`
 	}
-
-	// Set the current user in the node process
-	setCurrentUserInNode(currentUser)
-
-	fmt.Printf("\nUser logged in: %s\n", currentUser.Username)
+	if err := json.NewDecoder(resp.Body).Decode(&loginResponse); err != nil {
+		return err
+	}
+	sessionToken = loginResponse.SessionToken
+	currentUser = loginResponse.User
 	return nil
 }
 
-func setCurrentUserInNode(user *user.User) {
-	jsonData, err := json.Marshal(user)
+// logoutUser ends the session, the node stops the account's tor if no other client uses it
+func logoutUser() error {
+	resp, err := postToNode("/logout", nil)
 	if err != nil {
-		log.Fatal(err)
-	}
-
-	resp, err := client.Post(("https://localhost:18080/set-current-user"), "application/json", bytes.NewBuffer(jsonData))
-	if err != nil {
-		log.Fatal(err)
+		return err
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		log.Fatalf("Failed to set current user in node: %s", resp.Status)
+		return fmt.Errorf("failed to logout: %s", resp.Status)
 	}
+	sessionToken = ""
+	return nil
 }
 
 func showMainMenu() error {
@@ -236,7 +274,13 @@ func showMainMenu() error {
 		fmt.Println("____________________________")
 		fmt.Println("|6| => |Fetch messages|")
 		fmt.Println("____________________________")
-		fmt.Println("|7| => |Exit|")
+		fmt.Println("|7| => |Contact requests|")
+		fmt.Println("____________________________")
+		fmt.Println("|8| => |Receipt settings|")
+		fmt.Println("____________________________")
+		fmt.Println("|9| => |Chat|")
+		fmt.Println("____________________________")
+		fmt.Println("|10| => |Exit|")
 		fmt.Println("____________________________")
 		fmt.Print("Enter your choice => ")
 
@@ -257,8 +301,14 @@ func showMainMenu() error {
 		case "6":
 			fetchMessages()
 		case "7":
+			contactRequests()
+		case "8":
+			receiptSettings()
+		case "9":
+			chat()
+		case "10":
 			fmt.Println("Exiting...")
-			return nil
+			return logoutUser()
 		default:
 			fmt.Println("Invalid choice")
 		}
@@ -266,14 +316,33 @@ func showMainMenu() error {
 }
 
 func getContacts() ([]user.Contact, error) {
-	contacts, err := db.GetAllContacts()
+	contacts, err := fetchContacts()
 	if err != nil {
 		return nil, err
 	}
 
 	fmt.Println("Contacts:")
 	for i, contact := range contacts {
-		fmt.Printf("Contact %d: Username: %s\n", i+1, contact.Username)
+		fmt.Printf("Contact %d: %s (username %s, fingerprint %s)\n", i+1, contact.Nickname, contact.Username, contact.Fingerprint)
+	}
+	return contacts, nil
+}
+
+// fetchContacts asks the node for the contacts of the logged-in account
+func fetchContacts() ([]user.Contact, error) {
+	resp, err := postToNode("/contacts", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to fetch contacts: %s", resp.Status)
+	}
+
+	var contacts []user.Contact
+	if err := json.NewDecoder(resp.Body).Decode(&contacts); err != nil {
+		return nil, err
 	}
 	return contacts, nil
 }
@@ -284,101 +353,210 @@ func addContact() error {
 	onionAddress, _ := reader.ReadString('\n')
 	onionAddress = strings.TrimSpace(onionAddress)
 
-	// Wait at most a few minutes to start network and get a connection
-	dialCtx, dialCancel := context.WithTimeout(context.Background(), 60*time.Second)
-	defer dialCancel()
+	fmt.Println("Sending contact request to:", onionAddress) // Debug print
+	if err := requestContact(onionAddress); err != nil {
+		log.Fatal(err)
+	}
+
+	fmt.Println("Contact request sent, the contact is added once they accept it")
+	return nil
+}
 
-	// Make connection
-	dialer, err := torInstance.Dialer(dialCtx, &tor.DialConf{
-		ProxyAddress: "127.0.0.1:9060",
+// requestContact asks the node to send a contact request to an onion address
+func requestContact(onionAddress string) error {
+	// The node sends the contact request through the account's tor
+	jsonData, err := json.Marshal(map[string]string{
+		"onionAddress": onionAddress,
 	})
 	if err != nil {
-		log.Fatal("Can not dial to the proxy address", err)
+		return err
 	}
 
-	// Create HTTP client
-	client := &http.Client{
-		Transport: &http.Transport{
-			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
-			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
-				return dialer.DialContext(ctx, network, addr)
-			},
-		},
+	resp, err := postToNode("/send-contact-request", jsonData)
+	if err != nil {
+		return fmt.Errorf("failed to send contact request: %v", err)
 	}
+	defer resp.Body.Close()
 
-	// Send contact request to the given .onion address
-	contactData := map[string]interface{}{
-		"username":     currentUser.Username,
-		"onionAddress": currentUser.OnionAddress,
-		"publicKey":    currentUser.PublicKey,
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to send contact request: %s", resp.Status)
 	}
-	jsonData, err := json.Marshal(contactData)
+	return nil
+}
+
+// contactRequests lists the pending contact requests and lets the user answer them
+func contactRequests() error {
+	resp, err := postToNode("/contact-requests", nil)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
+	defer resp.Body.Close()
 
-	fmt.Println("Sending contact request to:", onionAddress) // Debug print
-	resp, err := client.Post(fmt.Sprintf("https://%s:18080/receive-contact-request", onionAddress), "application/json", bytes.NewBuffer(jsonData))
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to fetch contact requests: %s", resp.Status)
+	}
+
+	var requests []db.ContactRequest
+	if err := json.NewDecoder(resp.Body).Decode(&requests); err != nil {
+		return err
+	}
+	if len(requests) == 0 {
+		fmt.Println("No pending contact requests.")
+		return nil
+	}
+
+	fmt.Println("Pending contact requests:")
+	for i, req := range requests {
+		fmt.Printf("%d. [%s] %s (%s)\n", i+1, req.Created, req.ContactUsername, req.OnionAddress)
+	}
+
+	reader := bufio.NewReader(os.Stdin)
+	fmt.Print("Enter the number of the request to answer, or nothing to go back: ")
+	choiceStr, _ := reader.ReadString('\n')
+	choiceStr = strings.TrimSpace(choiceStr)
+	if choiceStr == "" {
+		return nil
+	}
+	choice, err := strconv.Atoi(choiceStr)
+	if err != nil || choice < 1 || choice > len(requests) {
+		fmt.Println("Invalid choice")
+		return nil
+	}
+	selected := requests[choice-1]
+
+	fmt.Printf("Do you accept the contact request of %s? (y/n): ", selected.ContactUsername)
+	answer, _ := reader.ReadString('\n')
+	answer = strings.TrimSpace(answer)
+
+	jsonData, err := json.Marshal(map[string]interface{}{
+		"id":     selected.ID,
+		"accept": answer == "y",
+	})
 	if err != nil {
-		log.Fatalf("Failed to send contact request: %v", err)
+		return err
+	}
+	resp, err = postToNode("/answer-contact-request", jsonData)
+	if err != nil {
+		return err
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		log.Fatalf("Failed to send contact request: %s", resp.Status)
-		fmt.Println(resp.Body)
-		fmt.Println(resp.Header)
-		fmt.Println(resp.Request.Header)
+		return fmt.Errorf("failed to answer contact request: %s", resp.Status)
 	}
+	if answer == "y" {
+		fmt.Println("Contact added, your contact data is sent to them in the background")
+	} else {
+		fmt.Println("Contact request rejected")
+	}
+	return nil
+}
 
-	// Send contact data to the local addContactHandler
-	localResp, err := client.Post(("https://localhost:18080/add-contact"), "application/json", bytes.NewBuffer(jsonData))
+// receiptSettings shows and changes which receipts are sent to a contact
+func receiptSettings() error {
+	contacts, err := getContacts()
 	if err != nil {
-		log.Fatalf("Failed to save contact... %v", err)
+		return err
+	}
+	if len(contacts) == 0 {
+		fmt.Println("No contacts available.")
+		return nil
 	}
-	defer localResp.Body.Close()
 
-	if localResp.StatusCode != http.StatusOK {
-		log.Fatalf("Failed to save contact... %s", localResp.Status)
+	reader := bufio.NewReader(os.Stdin)
+	fmt.Print("Enter the number of the contact: ")
+	choiceStr, _ := reader.ReadString('\n')
+	choice, err := strconv.Atoi(strings.TrimSpace(choiceStr))
+	if err != nil || choice < 1 || choice > len(contacts) {
+		fmt.Println("Invalid choice")
+		return nil
 	}
+	selectedContact := contacts[choice-1]
+
+	settings, err := postReceiptSettings(map[string]interface{}{"contact": selectedContact.Nickname})
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Delivery receipts to %s: %v\n", selectedContact.Nickname, settings["deliveryReceipts"])
+	fmt.Printf("Read receipts to %s: %v\n", selectedContact.Nickname, settings["readReceipts"])
+
+	fmt.Print("Send delivery receipts? (y/n, nothing keeps it): ")
+	delivered, _ := reader.ReadString('\n')
+	fmt.Print("Send read receipts? (y/n, nothing keeps it): ")
+	read, _ := reader.ReadString('\n')
 
-	fmt.Println("Contact request sent and saved successfully")
+	update := map[string]interface{}{"contact": selectedContact.Nickname}
+	if answer := strings.TrimSpace(delivered); answer != "" {
+		update["deliveryReceipts"] = answer == "y"
+	}
+	if answer := strings.TrimSpace(read); answer != "" {
+		update["readReceipts"] = answer == "y"
+	}
+	if len(update) == 1 {
+		return nil
+	}
+	if _, err := postReceiptSettings(update); err != nil {
+		return err
+	}
+	fmt.Println("Receipt settings saved")
 	return nil
 }
 
+// postReceiptSettings sends a receipt settings request and returns the contact's settings
+func postReceiptSettings(data map[string]interface{}) (map[string]bool, error) {
+	jsonData, err := json.Marshal(data)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := postToNode("/receipt-settings", jsonData)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to get receipt settings: %s", resp.Status)
+	}
+	var settings map[string]bool
+	if err := json.NewDecoder(resp.Body).Decode(&settings); err != nil {
+		return nil, err
+	}
+	return settings, nil
+}
+
 func getOnionAddress() error {
 	if currentUser == nil {
 		fmt.Println("No user logged in.")
 		return nil
 	}
 
-	// Send request to get onion address
-	userData := map[string]string{
-		"username": currentUser.Username,
-		"password": currentUser.Password,
-	}
-	jsonData, err := json.Marshal(userData)
+	onionAddress, err := fetchOnionAddress()
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	resp, err := client.Post(("https://localhost:18080/get-onion-address"), "application/json", bytes.NewBuffer(jsonData))
+	fmt.Printf("Your .onion address: %s\n", onionAddress)
+	return nil
+}
+
+// fetchOnionAddress asks the node for the account's onion address
+func fetchOnionAddress() (string, error) {
+	// Send request to get onion address, the node knows the user from the session
+	resp, err := postToNode("/get-onion-address", nil)
 	if err != nil {
-		log.Fatal(err)
+		return "", err
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		log.Fatalf("Failed to get onion address: %s", resp.Status)
+		return "", fmt.Errorf("failed to get onion address: %s", resp.Status)
 	}
 
 	var response map[string]string
 	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
-		log.Fatal(err)
+		return "", err
 	}
-
-	fmt.Printf("Your .onion address: %s\n", response["onionAddress"])
-	return nil
+	return response["onionAddress"], nil
 }
 
 func showQR() error {
@@ -410,7 +588,7 @@ func sendMessage() error {
 
 	fmt.Println("Select a contact to send a message:")
 	for i, contact := range contacts {
-		fmt.Printf("%d. %s\n", i+1, contact.Username)
+		fmt.Printf("%d. %s\n", i+1, contact.Nickname)
 	}
 
 	reader := bufio.NewReader(os.Stdin)
@@ -428,29 +606,46 @@ func sendMessage() error {
 	fmt.Print("Enter your message: ")
 	message, _ := reader.ReadString('\n')
 	message = strings.TrimSpace(message)
-	// Send the message to the node
+	if _, err := postMessage(selectedContact.Nickname, message); err != nil {
+		return err
+	}
+
+	fmt.Println("Message queued, the node delivers it as soon as the contact is reachable")
+	return nil
+}
+
+// sentMessage is the node's answer to /send-message
+type sentMessage struct {
+	ID    string `json:"id"`
+	Seq   int    `json:"seq"`
+	State string `json:"state"`
+}
+
+// postMessage hands a message to the node, which queues it for delivery
+func postMessage(receiver, message string) (sentMessage, error) {
 	messageData := map[string]interface{}{
 		"sender":   currentUser.Username,
-		"receiver": selectedContact.Username,
+		"receiver": receiver,
 		"message":  message,
 	}
 	jsonData, err := json.Marshal(messageData)
 	if err != nil {
-		return err
+		return sentMessage{}, err
 	}
 
-	resp, err := client.Post(("https://localhost:18080/send-message"), "application/json", bytes.NewBuffer(jsonData))
+	resp, err := postToNode("/send-message", jsonData)
 	if err != nil {
-		return err
+		return sentMessage{}, err
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("failed to send message: %s", resp.Status)
+		return sentMessage{}, fmt.Errorf("failed to send message: %s", resp.Status)
 	}
 
-	fmt.Println("Message sent successfully")
-	return nil
+	var sent sentMessage
+	err = json.NewDecoder(resp.Body).Decode(&sent)
+	return sent, err
 }
 
 func fetchMessages() error {
@@ -466,7 +661,7 @@ func fetchMessages() error {
 
 	fmt.Println("Select a contact to fetch messages:")
 	for i, contact := range contacts {
-		fmt.Printf("%d. %s\n", i+1, contact.Username)
+		fmt.Printf("%d. %s\n", i+1, contact.Nickname)
 	}
 
 	reader := bufio.NewReader(os.Stdin)
@@ -480,29 +675,41 @@ func fetchMessages() error {
 	}
 
 	selectedContact := contacts[choice-1]
+	return showConversation(selectedContact.Nickname)
+}
 
-	// Send request to fetch messages from the node
+// fetchConversation returns the decrypted messages of the conversation with a contact
+func fetchConversation(contactNickname string) ([]db.Message, error) {
 	messageData := map[string]interface{}{
 		"sender":   currentUser.Username,
-		"receiver": selectedContact.Username,
+		"receiver": contactNickname,
 	}
 	jsonData, err := json.Marshal(messageData)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	resp, err := client.Post(("https://localhost:18080/fetch-messages"), "application/json", bytes.NewBuffer(jsonData))
+	resp, err := postToNode("/fetch-messages", jsonData)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("failed to fetch messages: %s", resp.Status)
+		return nil, fmt.Errorf("failed to fetch messages: %s", resp.Status)
 	}
 
 	var messages []db.Message
 	if err := json.NewDecoder(resp.Body).Decode(&messages); err != nil {
+		return nil, err
+	}
+	return messages, nil
+}
+
+// showConversation prints the conversation with a contact
+func showConversation(contactNickname string) error {
+	messages, err := fetchConversation(contactNickname)
+	if err != nil {
 		return err
 	}
 
@@ -511,23 +718,57 @@ func fetchMessages() error {
 		return nil
 	}
 
-	fmt.Println("Messages with", selectedContact.Username)
+	// The node decrypts the messages, the private key never leaves it
+	fmt.Println("Messages with", contactNickname)
+	for _, line := range conversationLines(messages) {
+		fmt.Println(line)
+	}
+
+	return nil
+}
+
+// conversationLines renders a conversation, one line per message and per gap in the other senders' messages
+func conversationLines(messages []db.Message) []string {
+	var lines []string
+	lastSeq := make(map[string]int)
 	for _, msg := range messages {
-		if currentUser.Username == msg.Sender {
-			decryptedMessage, err := user.DecryptAES256(msg.Message, currentUser.RawPassword)
-			if err != nil {
-				fmt.Println("Failed to decrypt sended message: ", err)
-				return err
-			}
-			fmt.Printf("[%s] %s: %s\n", msg.Timestamp, msg.Sender, decryptedMessage)
-		} else {
-			decryptedMessage, err := user.DecryptMessage(msg.Message, currentUser.PrivateKey, currentUser.RawPassword)
-			if err != nil {
-				return err
+		// A jump in a sender's sequence numbers means messages haven't arrived (yet)
+		if !msg.Outgoing && msg.Seq > lastSeq[msg.Sender] {
+			if last := lastSeq[msg.Sender]; last > 0 && msg.Seq > last+1 {
+				lines = append(lines, fmt.Sprintf("... %d message(s) from %s missing", msg.Seq-last-1, msg.Sender))
 			}
-			fmt.Printf("[%s] %s: %s\n", msg.Timestamp, msg.Sender, decryptedMessage)
+			lastSeq[msg.Sender] = msg.Seq
+		}
+		lines = append(lines, formatMessage(msg))
+	}
+	return lines
+}
+
+// formatMessage renders a message as one line
+func formatMessage(msg db.Message) string {
+	// Messages carry the sender's time, older ones only the time they were stored
+	timestamp := msg.Timestamp
+	if msg.SentAt != 0 {
+		timestamp = formatTime(msg.SentAt)
+	}
+
+	if msg.Outgoing {
+		// Receipts from the contact tell more than the delivery state
+		state := msg.State
+		if msg.ReadAt != 0 {
+			state = "read " + formatTime(msg.ReadAt)
+		} else if msg.DeliveredAt != 0 {
+			state = "delivered " + formatTime(msg.DeliveredAt)
 		}
+		return fmt.Sprintf("[%s] %s (%s): %s", timestamp, msg.Sender, state, msg.Message)
 	}
+	if !msg.Verified {
+		return fmt.Sprintf("[%s] %s (unverified): %s", timestamp, msg.Sender, msg.Message)
+	}
+	return fmt.Sprintf("[%s] %s: %s", timestamp, msg.Sender, msg.Message)
+}
 
-	return nil
+// formatTime renders a unix time the way messages show it
+func formatTime(unix int64) string {
+	return time.Unix(unix, 0).Format("2006-01-02 15:04:05")
 }
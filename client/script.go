@@ -0,0 +1,471 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sote/db"
+	"sote/user"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/urfave/cli/v2"
+	"golang.org/x/term"
+)
+
+// Exit codes of the scriptable commands
+const (
+	exitFailure  = 1
+	exitUsage    = 2
+	exitAuth     = 3
+	exitNotFound = 4
+)
+
+// sessionPath is where the scriptable commands keep the session between runs
+var sessionPath string = "sote-session"
+
+// savedSession is the content of the session file
+type savedSession struct {
+	SessionToken string        `json:"sessionToken"`
+	User         *user.Profile `json:"user"`
+}
+
+// Flags shared by the scriptable commands
+var (
+	jsonFlag = &cli.BoolFlag{
+		Name:  "json",
+		Usage: "Print the result as JSON",
+	}
+	passwordEnvFlag = &cli.StringFlag{
+		Name:  "password-env",
+		Usage: "Read the password from this environment variable",
+		Value: "SOTE_PASSWORD",
+	}
+	passwordFdFlag = &cli.IntFlag{
+		Name:  "password-fd",
+		Usage: "Read the password from the first line of this file descriptor",
+		Value: -1,
+	}
+)
+
+// scriptCommands can be run without prompts, they keep the session in the session file
+var scriptCommands = []*cli.Command{
+	{
+		Name:      "register",
+		Usage:     "Register an account and log in with it",
+		ArgsUsage: "<username>",
+		Flags:     []cli.Flag{jsonFlag, passwordEnvFlag, passwordFdFlag},
+		Action:    registerCommand,
+	},
+	{
+		Name:      "login",
+		Usage:     "Log in and keep the session for the other commands",
+		ArgsUsage: "<username>",
+		Flags:     []cli.Flag{jsonFlag, passwordEnvFlag, passwordFdFlag},
+		Action:    loginCommand,
+	},
+	{
+		Name:   "logout",
+		Usage:  "End the kept session",
+		Action: logoutCommand,
+	},
+	{
+		Name:   "onion",
+		Usage:  "Print the account's .onion address",
+		Flags:  []cli.Flag{jsonFlag},
+		Action: onionCommand,
+	},
+	{
+		Name:  "contacts",
+		Usage: "List and add contacts",
+		Subcommands: []*cli.Command{
+			{
+				Name:   "list",
+				Usage:  "List the contacts",
+				Flags:  []cli.Flag{jsonFlag},
+				Action: listContactsCommand,
+			},
+			{
+				Name:      "add",
+				Usage:     "Send a contact request, the contact is added once they accept it",
+				ArgsUsage: "<onion address>",
+				Flags:     []cli.Flag{jsonFlag},
+				Action:    addContactCommand,
+			},
+			{
+				Name:      "rename",
+				Usage:     "Change the nickname of a contact",
+				ArgsUsage: "<contact> <nickname>",
+				Flags:     []cli.Flag{jsonFlag},
+				Action:    renameContactCommand,
+			},
+		},
+	},
+	{
+		Name:      "send",
+		Usage:     "Send a message, - reads it from stdin",
+		ArgsUsage: "<text|->",
+		Flags: []cli.Flag{
+			jsonFlag,
+			&cli.StringFlag{
+				Name:     "to",
+				Usage:    "Nickname or fingerprint of the contact",
+				Required: true,
+			},
+		},
+		Action: sendCommand,
+	},
+	{
+		Name:  "messages",
+		Usage: "Print the conversation with a contact",
+		Flags: []cli.Flag{
+			jsonFlag,
+			&cli.StringFlag{
+				Name:     "with",
+				Usage:    "Nickname or fingerprint of the contact",
+				Required: true,
+			},
+			&cli.StringFlag{
+				Name:  "since",
+				Usage: "Only messages after a duration ago (1h), RFC 3339 time or unix time",
+			},
+		},
+		Action: messagesCommand,
+	},
+}
+
+func registerCommand(c *cli.Context) error {
+	username, err := usernameArg(c)
+	if err != nil {
+		return err
+	}
+	password, err := readPassword(c)
+	if err != nil {
+		return err
+	}
+	if _, err := register(username, password); err != nil {
+		return cli.Exit(err, exitFailure)
+	}
+	return loginAndSave(c, username, password)
+}
+
+func loginCommand(c *cli.Context) error {
+	username, err := usernameArg(c)
+	if err != nil {
+		return err
+	}
+	password, err := readPassword(c)
+	if err != nil {
+		return err
+	}
+	return loginAndSave(c, username, password)
+}
+
+// loginAndSave logs in and writes the session file
+func loginAndSave(c *cli.Context, username, password string) error {
+	if err := login(username, password); err != nil {
+		return cli.Exit(err, exitAuth)
+	}
+
+	data, err := json.Marshal(savedSession{SessionToken: sessionToken, User: currentUser})
+	if err != nil {
+		return cli.Exit(err, exitFailure)
+	}
+	// The token is as good as the password while the node runs
+	if err := os.WriteFile(sessionPath, data, 0600); err != nil {
+		return cli.Exit(err, exitFailure)
+	}
+
+	return printResult(c, currentUser, "Logged in as "+currentUser.Username)
+}
+
+func logoutCommand(c *cli.Context) error {
+	if err := loadSession(); err != nil {
+		return err
+	}
+	err := logoutUser()
+	// The session is useless once the node forgot it, remove it either way
+	if rmErr := os.Remove(sessionPath); rmErr != nil && err == nil {
+		err = rmErr
+	}
+	if err != nil {
+		return cli.Exit(err, exitFailure)
+	}
+	return nil
+}
+
+func onionCommand(c *cli.Context) error {
+	if err := loadSession(); err != nil {
+		return err
+	}
+	onionAddress, err := fetchOnionAddress()
+	if err != nil {
+		return cli.Exit(err, exitFailure)
+	}
+	return printResult(c, map[string]string{"onionAddress": onionAddress}, onionAddress)
+}
+
+func listContactsCommand(c *cli.Context) error {
+	if err := loadSession(); err != nil {
+		return err
+	}
+	contacts, err := fetchContacts()
+	if err != nil {
+		return cli.Exit(err, exitFailure)
+	}
+
+	output := []contactOutput{}
+	var lines []string
+	for _, contact := range contacts {
+		output = append(output, newContactOutput(contact))
+		lines = append(lines, contactLine(contact))
+	}
+	return printResult(c, output, strings.Join(lines, "\n"))
+}
+
+func renameContactCommand(c *cli.Context) error {
+	if c.NArg() != 2 || strings.TrimSpace(c.Args().Get(1)) == "" {
+		return cli.Exit("give the contact and its new nickname", exitUsage)
+	}
+	if err := loadSession(); err != nil {
+		return err
+	}
+	contactNickname, err := contactName(strings.TrimSpace(c.Args().Get(0)))
+	if err != nil {
+		return err
+	}
+
+	var contact user.Contact
+	err = postNodeRequest("/rename-contact", map[string]string{"contact": contactNickname, "nickname": c.Args().Get(1)}, &contact)
+	if err != nil {
+		return cli.Exit(err, exitFailure)
+	}
+	return printResult(c, newContactOutput(contact), contactLine(contact))
+}
+
+// contactOutput is a contact as --json prints it
+type contactOutput struct {
+	Nickname     string `json:"nickname"`
+	Username     string `json:"username"`
+	Fingerprint  string `json:"fingerprint"`
+	OnionAddress string `json:"onionAddress"`
+}
+
+func newContactOutput(contact user.Contact) contactOutput {
+	return contactOutput{Nickname: contact.Nickname, Username: contact.Username, Fingerprint: contact.Fingerprint, OnionAddress: contact.OnionAddress}
+}
+
+// contactLine describes a contact in one line
+func contactLine(contact user.Contact) string {
+	return strings.Join([]string{contact.Nickname, contact.Username, contact.Fingerprint, contact.OnionAddress}, "\t")
+}
+
+func addContactCommand(c *cli.Context) error {
+	if c.NArg() != 1 {
+		return cli.Exit("give the .onion address of the contact", exitUsage)
+	}
+	if err := loadSession(); err != nil {
+		return err
+	}
+	onionAddress := strings.TrimSpace(c.Args().First())
+	if err := requestContact(onionAddress); err != nil {
+		return cli.Exit(err, exitFailure)
+	}
+	return printResult(c, map[string]string{"onionAddress": onionAddress, "status": db.ContactRequestPending},
+		"Contact request sent, the contact is added once they accept it")
+}
+
+func sendCommand(c *cli.Context) error {
+	if c.NArg() == 0 {
+		return cli.Exit("give the message, or - to read it from stdin", exitUsage)
+	}
+	message := strings.Join(c.Args().Slice(), " ")
+	if message == "-" {
+		data, err := io.ReadAll(os.Stdin)
+		if err != nil {
+			return cli.Exit(err, exitFailure)
+		}
+		message = strings.TrimRight(string(data), "\n")
+	}
+	if message == "" {
+		return cli.Exit("the message is empty", exitUsage)
+	}
+
+	if err := loadSession(); err != nil {
+		return err
+	}
+	contactNickname, err := contactFlag(c, "to")
+	if err != nil {
+		return err
+	}
+	sent, err := postMessage(contactNickname, message)
+	if err != nil {
+		return cli.Exit(err, exitFailure)
+	}
+	return printResult(c, sent, fmt.Sprintf("Message %s %s", sent.ID, sent.State))
+}
+
+func messagesCommand(c *cli.Context) error {
+	var since time.Time
+	if c.String("since") != "" {
+		var err error
+		if since, err = parseSince(c.String("since")); err != nil {
+			return cli.Exit(err, exitUsage)
+		}
+	}
+
+	if err := loadSession(); err != nil {
+		return err
+	}
+	contactNickname, err := contactFlag(c, "with")
+	if err != nil {
+		return err
+	}
+	messages, err := fetchConversation(contactNickname)
+	if err != nil {
+		return cli.Exit(err, exitFailure)
+	}
+
+	type messageOutput struct {
+		ID          string `json:"id"`
+		Sender      string `json:"sender"`
+		Receiver    string `json:"receiver"`
+		Message     string `json:"message"`
+		SentAt      int64  `json:"sentAt"`
+		Seq         int    `json:"seq"`
+		Verified    bool   `json:"verified"`
+		State       string `json:"state,omitempty"`
+		DeliveredAt int64  `json:"deliveredAt,omitempty"`
+		ReadAt      int64  `json:"readAt,omitempty"`
+	}
+	output := []messageOutput{}
+	var shown []db.Message
+	for _, msg := range messages {
+		sentAt := messageTime(msg)
+		if !since.IsZero() && !sentAt.After(since) {
+			continue
+		}
+		shown = append(shown, msg)
+		output = append(output, messageOutput{
+			ID:          msg.UUID,
+			Sender:      msg.Sender,
+			Receiver:    msg.Receiver,
+			Message:     string(msg.Message),
+			SentAt:      sentAt.Unix(),
+			Seq:         msg.Seq,
+			Verified:    msg.Verified,
+			State:       msg.State,
+			DeliveredAt: msg.DeliveredAt,
+			ReadAt:      msg.ReadAt,
+		})
+	}
+	return printResult(c, output, strings.Join(conversationLines(shown), "\n"))
+}
+
+// loadSession reads the session written by login
+func loadSession() error {
+	data, err := os.ReadFile(sessionPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return cli.Exit("not logged in, run `sote-client login` first", exitAuth)
+	}
+	if err != nil {
+		return cli.Exit(err, exitFailure)
+	}
+
+	var session savedSession
+	if err := json.Unmarshal(data, &session); err != nil || session.SessionToken == "" || session.User == nil {
+		return cli.Exit("the session file is damaged, run `sote-client login` again", exitAuth)
+	}
+	sessionToken = session.SessionToken
+	currentUser = session.User
+	return nil
+}
+
+// usernameArg returns the username given as the only argument
+func usernameArg(c *cli.Context) (string, error) {
+	if c.NArg() != 1 || strings.TrimSpace(c.Args().First()) == "" {
+		return "", cli.Exit("give the username", exitUsage)
+	}
+	return strings.TrimSpace(c.Args().First()), nil
+}
+
+// contactFlag returns the contact named by a flag, if it is a contact
+func contactFlag(c *cli.Context, name string) (string, error) {
+	return contactName(strings.TrimSpace(c.String(name)))
+}
+
+// readPassword reads the password from the file descriptor or environment variable given by the
+// flags, and prompts for it only when stdin is a terminal
+func readPassword(c *cli.Context) (string, error) {
+	if fd := c.Int("password-fd"); fd >= 0 {
+		file := os.NewFile(uintptr(fd), "password-fd")
+		if file == nil {
+			return "", cli.Exit("invalid --password-fd", exitUsage)
+		}
+		defer file.Close()
+		line, err := bufio.NewReader(file).ReadString('\n')
+		if err != nil && err != io.EOF {
+			return "", cli.Exit(err, exitFailure)
+		}
+		return strings.TrimRight(line, "\r\n"), nil
+	}
+	if password, ok := os.LookupEnv(c.String("password-env")); ok {
+		return password, nil
+	}
+
+	if !term.IsTerminal(int(os.Stdin.Fd())) {
+		return "", cli.Exit("no password, set "+c.String("password-env")+" or use --password-fd", exitUsage)
+	}
+	fmt.Fprint(os.Stderr, "Enter password: ")
+	password, err := term.ReadPassword(int(os.Stdin.Fd()))
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return "", cli.Exit(err, exitFailure)
+	}
+	return strings.TrimSpace(string(password)), nil
+}
+
+// parseSince reads a duration ago, an RFC 3339 time or a unix time
+func parseSince(value string) (time.Time, error) {
+	if d, err := time.ParseDuration(value); err == nil {
+		return time.Now().Add(-d), nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	if unix, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return time.Unix(unix, 0), nil
+	}
+	return time.Time{}, fmt.Errorf("invalid --since %q, use a duration (1h), RFC 3339 time or unix time", value)
+}
+
+// messageTime is when a message was sent, older messages only have the time they were stored
+func messageTime(msg db.Message) time.Time {
+	if msg.SentAt != 0 {
+		return time.Unix(msg.SentAt, 0)
+	}
+	// SQLite's CURRENT_TIMESTAMP is UTC
+	t, err := time.Parse("2006-01-02 15:04:05", msg.Timestamp)
+	if err != nil {
+		return time.Time{}
+	}
+	return t
+}
+
+// printResult prints data as JSON with --json, text otherwise
+func printResult(c *cli.Context, data interface{}, text string) error {
+	if c.Bool("json") {
+		if err := json.NewEncoder(os.Stdout).Encode(data); err != nil {
+			return cli.Exit(err, exitFailure)
+		}
+		return nil
+	}
+	if text != "" {
+		fmt.Println(text)
+	}
+	return nil
+}
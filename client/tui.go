@@ -0,0 +1,507 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"sote/db"
+	"sote/user"
+	"strings"
+
+	"github.com/gdamore/tcell/v2"
+	"github.com/mattn/go-runewidth"
+	"github.com/mdp/qrterminal/v3"
+	"github.com/urfave/cli/v2"
+)
+
+// Width of the contact list pane
+const tuiContactsWidth = 24
+
+// tuiHelp is shown in the status line when there is nothing else to say
+const tuiHelp = "Enter send | Up/Down contact | PgUp/PgDn scroll | F2 add contact | F3 QR | F4 switch account | Esc quit"
+
+// tuiPrompt asks for one line of input in place of the message box
+type tuiPrompt struct {
+	label  string
+	masked bool
+	done   func(string)
+}
+
+// tui is the state of the full-screen client. It is only touched from the
+// screen's event loop, the event stream hands its events over with PostEvent.
+type tui struct {
+	screen       tcell.Screen
+	contacts     []user.Contact
+	selected     int
+	conversation []db.Message
+	scroll       int
+	unread       map[string]int
+	input        []rune
+	prompt       *tuiPrompt
+	status       string
+	showQR       bool
+	cancelEvents context.CancelFunc
+	quit         bool
+}
+
+// tuiStreamError is posted when the event stream closes
+type tuiStreamError struct {
+	err error
+}
+
+// tuiCommand runs the full-screen client
+func tuiCommand(c *cli.Context) error {
+	screen, err := tcell.NewScreen()
+	if err != nil {
+		return err
+	}
+	if err := screen.Init(); err != nil {
+		return err
+	}
+	defer screen.Fini()
+
+	t := &tui{screen: screen, unread: make(map[string]int)}
+	t.askLogin()
+
+	for !t.quit {
+		t.draw()
+		switch ev := screen.PollEvent().(type) {
+		case *tcell.EventResize:
+			screen.Sync()
+		case *tcell.EventKey:
+			t.handleKey(ev)
+		case *tcell.EventInterrupt:
+			t.handleInterrupt(ev.Data())
+		}
+	}
+
+	t.stopEvents()
+	if sessionToken != "" {
+		return logoutUser()
+	}
+	return nil
+}
+
+// askLogin prompts for a username and password and logs in with them
+func (t *tui) askLogin() {
+	t.ask("Username: ", false, func(username string) {
+		t.ask("Password: ", true, func(password string) {
+			if err := login(username, strings.TrimSpace(password)); err != nil {
+				t.status = err.Error()
+				t.askLogin()
+				return
+			}
+			t.status = "Logged in as " + currentUser.Username
+			t.loggedIn()
+		})
+	})
+}
+
+// ask replaces the message box with a prompt until enter or esc is pressed
+func (t *tui) ask(label string, masked bool, done func(string)) {
+	t.input = nil
+	t.prompt = &tuiPrompt{label: label, masked: masked, done: done}
+}
+
+// loggedIn loads the account's contacts and starts following its events
+func (t *tui) loggedIn() {
+	t.unread = make(map[string]int)
+	t.selected = 0
+	t.showQR = false
+	t.loadContacts()
+	t.loadConversation()
+	t.startEvents()
+}
+
+// startEvents streams the node's events into the screen's event loop
+func (t *tui) startEvents() {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.cancelEvents = cancel
+	go func() {
+		err := streamEvents(ctx, func(ev nodeEvent) {
+			t.screen.PostEvent(tcell.NewEventInterrupt(ev))
+		})
+		if ctx.Err() == nil {
+			t.screen.PostEvent(tcell.NewEventInterrupt(tuiStreamError{err: err}))
+		}
+	}()
+}
+
+// stopEvents stops the event stream of the current account
+func (t *tui) stopEvents() {
+	if t.cancelEvents != nil {
+		t.cancelEvents()
+		t.cancelEvents = nil
+	}
+}
+
+// loadContacts reads the contact list, keeping the selected contact if it's still there
+func (t *tui) loadContacts() {
+	selected := t.selectedContact()
+	contacts, err := fetchContacts()
+	if err != nil {
+		t.status = "Failed to load contacts: " + err.Error()
+		return
+	}
+	t.contacts = contacts
+	t.selected = 0
+	for i, contact := range contacts {
+		if contact.Nickname == selected {
+			t.selected = i
+		}
+	}
+}
+
+// selectedContact returns the nickname of the selected contact, empty without contacts
+func (t *tui) selectedContact() string {
+	if t.selected < 0 || t.selected >= len(t.contacts) {
+		return ""
+	}
+	return t.contacts[t.selected].Nickname
+}
+
+// loadConversation fetches the conversation with the selected contact, the node marks it read
+func (t *tui) loadConversation() {
+	contact := t.selectedContact()
+	if contact == "" {
+		t.conversation = nil
+		return
+	}
+	messages, err := fetchConversation(contact)
+	if err != nil {
+		t.status = "Failed to fetch messages: " + err.Error()
+		return
+	}
+	t.conversation = messages
+	delete(t.unread, contact)
+}
+
+// selectContact switches the conversation pane to another contact
+func (t *tui) selectContact(i int) {
+	if i < 0 || i >= len(t.contacts) || i == t.selected {
+		return
+	}
+	t.selected = i
+	t.scroll = 0
+	t.showQR = false
+	t.loadConversation()
+}
+
+func (t *tui) handleKey(ev *tcell.EventKey) {
+	// A status is shown until the next key press
+	t.status = ""
+	switch ev.Key() {
+	case tcell.KeyCtrlC:
+		t.quit = true
+	case tcell.KeyEscape:
+		if t.prompt != nil && sessionToken != "" {
+			t.prompt = nil
+			t.input = nil
+			return
+		}
+		t.quit = true
+	case tcell.KeyEnter:
+		line := string(t.input)
+		t.input = nil
+		if t.prompt != nil {
+			prompt := t.prompt
+			t.prompt = nil
+			prompt.done(line)
+			return
+		}
+		t.send(strings.TrimSpace(line))
+	case tcell.KeyBackspace, tcell.KeyBackspace2:
+		if len(t.input) > 0 {
+			t.input = t.input[:len(t.input)-1]
+		}
+	case tcell.KeyRune:
+		t.input = append(t.input, ev.Rune())
+	}
+
+	// The remaining keys need a logged in account
+	if t.prompt != nil {
+		return
+	}
+	switch ev.Key() {
+	case tcell.KeyUp:
+		t.selectContact(t.selected - 1)
+	case tcell.KeyDown:
+		t.selectContact(t.selected + 1)
+	case tcell.KeyPgUp:
+		t.scroll += t.pageSize()
+	case tcell.KeyPgDn:
+		t.scroll -= t.pageSize()
+		if t.scroll < 0 {
+			t.scroll = 0
+		}
+	case tcell.KeyF2:
+		t.ask("Contact .onion address: ", false, func(onionAddress string) {
+			onionAddress = strings.TrimSpace(onionAddress)
+			if onionAddress == "" {
+				return
+			}
+			if err := requestContact(onionAddress); err != nil {
+				t.status = err.Error()
+				return
+			}
+			t.status = "Contact request sent, the contact is added once they accept it"
+		})
+	case tcell.KeyF3:
+		t.showQR = !t.showQR
+	case tcell.KeyF4:
+		t.switchAccount()
+	}
+}
+
+// send sends the message box to the selected contact
+func (t *tui) send(message string) {
+	contact := t.selectedContact()
+	if message == "" || contact == "" {
+		return
+	}
+	if _, err := postMessage(contact, message); err != nil {
+		t.status = "Failed to send message: " + err.Error()
+		return
+	}
+	t.scroll = 0
+	t.loadConversation()
+}
+
+// switchAccount logs out and asks for another account to log in with
+func (t *tui) switchAccount() {
+	t.stopEvents()
+	if err := logoutUser(); err != nil {
+		t.status = err.Error()
+		t.startEvents()
+		return
+	}
+	currentUser = nil
+	t.contacts = nil
+	t.conversation = nil
+	t.showQR = false
+	t.askLogin()
+}
+
+// handleInterrupt updates the screen for an event of the node
+func (t *tui) handleInterrupt(data interface{}) {
+	if streamErr, ok := data.(tuiStreamError); ok {
+		if streamErr.err != nil {
+			t.status = "Event stream closed: " + streamErr.err.Error()
+		} else {
+			t.status = "Event stream closed"
+		}
+		return
+	}
+	ev, ok := data.(nodeEvent)
+	if !ok {
+		return
+	}
+
+	switch ev.Type {
+	case "message":
+		var msg messageEventData
+		if json.Unmarshal(ev.Data, &msg) != nil {
+			return
+		}
+		if msg.Group != "" {
+			t.status = "New group message from " + msg.Sender
+			return
+		}
+		if msg.Sender == t.selectedContact() {
+			t.loadConversation()
+			return
+		}
+		t.unread[msg.Sender]++
+	case "delivery":
+		var delivery deliveryEventData
+		if json.Unmarshal(ev.Data, &delivery) == nil && delivery.Contact == t.selectedContact() {
+			t.loadConversation()
+		}
+	case "receipt":
+		var receipt receiptEventData
+		if json.Unmarshal(ev.Data, &receipt) == nil && receipt.Contact == t.selectedContact() {
+			t.loadConversation()
+		}
+	case "contact-request":
+		var request contactEventData
+		if json.Unmarshal(ev.Data, &request) == nil {
+			t.status = fmt.Sprintf("Contact request from %s, answer it with `sote-client start`", request.Username)
+		}
+	case "contact":
+		var contact contactEventData
+		if json.Unmarshal(ev.Data, &contact) == nil {
+			t.status = contact.Username + " accepted your contact request"
+			t.loadContacts()
+			if len(t.contacts) == 1 {
+				t.loadConversation()
+			}
+		}
+	}
+}
+
+// pageSize is the number of conversation lines scrolled by PgUp/PgDn
+func (t *tui) pageSize() int {
+	_, height := t.screen.Size()
+	if height > 6 {
+		return height - 5
+	}
+	return 1
+}
+
+func (t *tui) draw() {
+	t.screen.Clear()
+	width, height := t.screen.Size()
+	if width < tuiContactsWidth+10 || height < 5 {
+		drawText(t.screen, 0, 0, width, tcell.StyleDefault, "Terminal too small")
+		t.screen.Show()
+		return
+	}
+	bold := tcell.StyleDefault.Bold(true)
+
+	// Header
+	header := " SOTE"
+	if currentUser != nil {
+		header += " | " + currentUser.Username + " | " + currentUser.OnionAddress
+	}
+	drawText(t.screen, 0, 0, width, bold.Reverse(true), padRight(header, width))
+
+	// Contact list and separator
+	top, bottom := 1, height-3
+	for y := top; y <= bottom; y++ {
+		t.screen.SetContent(tuiContactsWidth, y, tcell.RuneVLine, nil, tcell.StyleDefault)
+	}
+	for i, contact := range t.contacts {
+		y := top + i
+		if y > bottom {
+			break
+		}
+		name := contact.Nickname
+		if n := t.unread[contact.Nickname]; n > 0 {
+			name = fmt.Sprintf("%s (%d)", name, n)
+		}
+		style := tcell.StyleDefault
+		if i == t.selected {
+			style = style.Reverse(true)
+		}
+		drawText(t.screen, 0, y, tuiContactsWidth, style, padRight(" "+name, tuiContactsWidth))
+	}
+	if len(t.contacts) == 0 && currentUser != nil {
+		drawText(t.screen, 1, top, tuiContactsWidth, tcell.StyleDefault.Dim(true), "No contacts, F2 adds one")
+	}
+
+	// Conversation or QR code
+	left := tuiContactsWidth + 2
+	if t.showQR && currentUser != nil {
+		t.drawQR(left, top, width)
+	} else {
+		t.drawConversation(left, top, width, bottom)
+	}
+
+	// Message box
+	for x := 0; x < width; x++ {
+		t.screen.SetContent(x, height-2, tcell.RuneHLine, nil, tcell.StyleDefault)
+	}
+	label := "> "
+	input := string(t.input)
+	if t.prompt != nil {
+		label = t.prompt.label
+		if t.prompt.masked {
+			input = strings.Repeat("*", len(t.input))
+		}
+	} else if contact := t.selectedContact(); contact != "" {
+		label = contact + "> "
+	}
+	x := drawText(t.screen, 0, height-1, width, bold, label)
+	x = drawText(t.screen, x, height-1, width, tcell.StyleDefault, input)
+	t.screen.ShowCursor(x, height-1)
+
+	// Status line, the last row of the conversation pane
+	status := t.status
+	if status == "" {
+		status = tuiHelp
+	}
+	drawText(t.screen, left, bottom, width, tcell.StyleDefault.Dim(true), status)
+
+	t.screen.Show()
+}
+
+// drawConversation draws the selected conversation, the newest messages at the bottom
+func (t *tui) drawConversation(left, top, width, bottom int) {
+	// The last row of the pane is the status line
+	rows := bottom - top
+	var lines []string
+	for _, line := range conversationLines(t.conversation) {
+		lines = append(lines, wrapText(line, width-left)...)
+	}
+
+	maxScroll := len(lines) - rows
+	if maxScroll < 0 {
+		maxScroll = 0
+	}
+	if t.scroll > maxScroll {
+		t.scroll = maxScroll
+	}
+	end := len(lines) - t.scroll
+	start := end - rows
+	if start < 0 {
+		start = 0
+	}
+	for i, line := range lines[start:end] {
+		drawText(t.screen, left, top+i, width, tcell.StyleDefault, line)
+	}
+}
+
+// drawQR draws the account's onion address as a QR code
+func (t *tui) drawQR(left, top, width int) {
+	var buf bytes.Buffer
+	qrterminal.GenerateHalfBlock(currentUser.OnionAddress, qrterminal.M, &buf)
+	style := tcell.StyleDefault.Foreground(tcell.ColorWhite).Background(tcell.ColorBlack)
+	for i, line := range strings.Split(strings.TrimRight(buf.String(), "\n"), "\n") {
+		drawText(t.screen, left, top+i, width, style, line)
+	}
+}
+
+// drawText draws s from x up to maxX and returns the column after it
+func drawText(screen tcell.Screen, x, y, maxX int, style tcell.Style, s string) int {
+	for _, r := range s {
+		w := runewidth.RuneWidth(r)
+		if w == 0 {
+			continue
+		}
+		if x+w > maxX {
+			break
+		}
+		screen.SetContent(x, y, r, nil, style)
+		x += w
+	}
+	return x
+}
+
+// padRight fills s with spaces up to width columns
+func padRight(s string, width int) string {
+	if n := runewidth.StringWidth(s); n < width {
+		return s + strings.Repeat(" ", width-n)
+	}
+	return s
+}
+
+// wrapText breaks s into lines of at most width columns
+func wrapText(s string, width int) []string {
+	if width <= 0 {
+		return []string{s}
+	}
+	var lines []string
+	var line []rune
+	lineWidth := 0
+	for _, r := range s {
+		w := runewidth.RuneWidth(r)
+		if lineWidth+w > width {
+			lines = append(lines, string(line))
+			line, lineWidth = nil, 0
+		}
+		line = append(line, r)
+		lineWidth += w
+	}
+	return append(lines, string(line))
+}
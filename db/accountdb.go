@@ -0,0 +1,203 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// ErrAccountLocked is returned when an account's data is used while the account isn't unlocked
+var ErrAccountLocked = errors.New("account is locked")
+
+// accountTables are the tables whose rows belong to one account by their userId,
+// parents before the rows that reference them
+var accountTables = []string{"contacts", "messages", "outbox", "receipts", "contact_requests", "chat_groups", "group_members", "group_updates"}
+
+// GetDataKey retrieves the account's data key, encrypted with the key derived from the password.
+// Accounts that were never unlocked since accounts had data keys return nil.
+func (s *SQLiteStore) GetDataKey(username string) ([]byte, error) {
+	var dataKey []byte
+	err := s.db.QueryRow("SELECT dataKey FROM user WHERE username = ?", username).Scan(&dataKey)
+	return dataKey, notFound(err)
+}
+
+// SetDataKey stores the encrypted data key of an account that has none yet
+func (s *SQLiteStore) SetDataKey(username string, dataKey []byte) error {
+	result, err := s.db.Exec("UPDATE user SET dataKey = ? WHERE username = ? AND dataKey IS NULL", dataKey, username)
+	if err != nil {
+		return err
+	}
+	if updated, err := result.RowsAffected(); err != nil || updated == 0 {
+		return errors.New("account already has a data key")
+	}
+	return nil
+}
+
+// OpenAccount unlocks an account's data by opening its database with the data key.
+// Rows the account still has in the main database are moved into it.
+func (s *SQLiteStore) OpenAccount(userID int, dataKey []byte) error {
+	s.accountDBsMu.Lock()
+	defer s.accountDBsMu.Unlock()
+	if _, ok := s.accountDBs[userID]; ok {
+		return nil
+	}
+
+	var username, onionAddress string
+	var publicKey []byte
+	err := s.db.QueryRow("SELECT username, onionAddress, publicKey FROM user WHERE id = ?", userID).Scan(&username, &onionAddress, &publicKey)
+	if err != nil {
+		return notFound(err)
+	}
+
+	path, conn, err := s.openAccountDB(userID, dataKey)
+	if err != nil {
+		return err
+	}
+	// A wrong key fails on the first read, which is the migration
+	if err := migrate(conn); err != nil {
+		conn.Close()
+		return err
+	}
+
+	// Contacts reference the account's row, the database keeps a copy of its public part
+	_, err = conn.Exec("INSERT OR IGNORE INTO user (id, username, onionAddress, publicKey) VALUES (?, ?, ?, ?)", userID, username, onionAddress, publicKey)
+	if err == nil && !s.memory {
+		err = s.moveAccountData(conn, path, userID, username)
+	}
+	if err != nil {
+		conn.Close()
+		return err
+	}
+
+	s.accountDBs[userID] = conn
+	return nil
+}
+
+// openAccountDB opens the database of an account with its data key and returns its path
+func (s *SQLiteStore) openAccountDB(userID int, dataKey []byte) (string, *sql.DB, error) {
+	if s.memory {
+		conn, err := openMemoryDB()
+		return ":memory:", conn, err
+	}
+	if err := os.MkdirAll(s.accountDir, 0700); err != nil {
+		return "", nil, err
+	}
+	path := filepath.Join(s.accountDir, fmt.Sprintf("%d.db", userID))
+	conn, err := sql.Open("sqlite3", fmt.Sprintf("%s?_pragma_key=x'%s'&_foreign_keys=on", path, hex.EncodeToString(dataKey)))
+	return path, conn, err
+}
+
+// CloseAccount locks an account's data again
+func (s *SQLiteStore) CloseAccount(userID int) error {
+	s.accountDBsMu.Lock()
+	defer s.accountDBsMu.Unlock()
+	conn, ok := s.accountDBs[userID]
+	if !ok {
+		return nil
+	}
+	delete(s.accountDBs, userID)
+	return conn.Close()
+}
+
+// accountDB returns the database of an unlocked account
+func (s *SQLiteStore) accountDB(userID int) (*sql.DB, error) {
+	s.accountDBsMu.Lock()
+	defer s.accountDBsMu.Unlock()
+	conn, ok := s.accountDBs[userID]
+	if !ok {
+		return nil, ErrAccountLocked
+	}
+	return conn, nil
+}
+
+// moveAccountData moves the rows of an account that are still in the plaintext main database into
+// its encrypted database in one transaction, and vacuums the main database so they don't linger there
+func (s *SQLiteStore) moveAccountData(conn *sql.DB, path string, userID int, username string) error {
+	var legacyRows int
+	for _, table := range accountTables {
+		var count int
+		err := s.db.QueryRow("SELECT COUNT(*) FROM "+table+" WHERE userId = ?", userID).Scan(&count)
+		if err != nil {
+			return err
+		}
+		legacyRows += count
+	}
+	if legacyRows == 0 {
+		return nil
+	}
+
+	// ATTACH only applies to the connection it runs on
+	ctx := context.Background()
+	c, err := conn.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	if _, err := c.ExecContext(ctx, "ATTACH DATABASE ? AS legacy KEY ''", s.path); err != nil {
+		return err
+	}
+	defer c.ExecContext(ctx, "DETACH DATABASE legacy")
+
+	tx, err := c.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, table := range accountTables {
+		columns, err := tableColumns(tx, table)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec("INSERT INTO main."+table+" ("+columns+") SELECT "+columns+" FROM legacy."+table+" WHERE userId = ?", userID)
+		if err != nil {
+			return fmt.Errorf("error moving %s: %v", table, err)
+		}
+	}
+	// Rows that reference others are removed first
+	for i := len(accountTables) - 1; i >= 0; i-- {
+		if _, err := tx.Exec("DELETE FROM legacy."+accountTables[i]+" WHERE userId = ?", userID); err != nil {
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	log.Printf("Moved %d rows of %s into its encrypted database %s\n", legacyRows, username, path) // Debug print
+
+	_, err = s.db.Exec("VACUUM")
+	return err
+}
+
+// tableColumns returns the comma separated columns of a table in the main database
+func tableColumns(tx *sql.Tx, table string) (string, error) {
+	rows, err := tx.Query(fmt.Sprintf("PRAGMA main.table_info(%s)", table))
+	if err != nil {
+		return "", err
+	}
+	defer rows.Close()
+
+	var columns string
+	for rows.Next() {
+		var (
+			cid        int
+			name       string
+			columnType string
+			notNull    int
+			dfltValue  sql.NullString
+			pk         int
+		)
+		if err := rows.Scan(&cid, &name, &columnType, &notNull, &dfltValue, &pk); err != nil {
+			return "", err
+		}
+		if columns != "" {
+			columns += ", "
+		}
+		columns += `"` + name + `"`
+	}
+	return columns, rows.Err()
+}
@@ -2,138 +2,379 @@ package db
 
 import (
 	"database/sql"
+	"errors"
 	"fmt"
 	"log"
+	"path/filepath"
 	"sote/user"
+	"strings"
+	"sync"
 
-	_ "github.com/mattn/go-sqlite3"
+	_ "github.com/mutecomm/go-sqlcipher/v4"
 )
 
-var db *sql.DB
+// SQLiteStore is the Store kept in SQLite databases. The main database holds the accounts and
+// the node's settings, each account's contacts and messages are in its own database in accountDir.
+type SQLiteStore struct {
+	db         *sql.DB
+	path       string
+	accountDir string
+	// memory keeps the account databases in memory too, see NewMemoryStore
+	memory bool
 
-// Initialize initializes the database
-func Initialize() {
-	var err error
-	db, err = sql.Open("sqlite3", "./localDB.db")
-	if err != nil {
-		log.Fatal(err)
-	}
-
-	createTable()
+	// accountDBs holds the open databases of unlocked accounts by account ID
+	accountDBs   map[int]*sql.DB
+	accountDBsMu sync.Mutex
 }
 
-// createTable creates the user and contacts tables if they don't exist
-func createTable() {
-	createUserTableSQL := `CREATE TABLE IF NOT EXISTS user (
-        "id" INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
-        "username" TEXT UNIQUE,
-        "password" TEXT,
-        "privateKey" BLOB,
-        "publicKey" BLOB,
-        "onionAddress" TEXT,
-        "torrcFilePath" TEXT
-    );`
-
-	createContactsTableSQL := `CREATE TABLE IF NOT EXISTS contacts (
-        "id" INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
-        "username" TEXT,
-        "contactUsername" TEXT,
-        "contactOnionAddress" TEXT,
-        "contactPublicKey" BLOB
-    );`
-
-	createMessagesTableSQL := `CREATE TABLE IF NOT EXISTS messages (
-        "id" INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
-        "sender" TEXT,
-        "receiver" TEXT,
-        "message" BLOB,
-        "timestamp" DATETIME DEFAULT CURRENT_TIMESTAMP
-    );`
-
-	_, err := db.Exec(createUserTableSQL)
+// NewSQLiteStore opens the database at path, account databases are kept in an accounts directory next to it
+func NewSQLiteStore(path string) (*SQLiteStore, error) {
+	// Contacts and messages reference the account they belong to, SQLite only enforces that when asked
+	conn, err := sql.Open("sqlite3", path+"?_foreign_keys=on")
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
+	return newSQLiteStore(conn, path, filepath.Join(filepath.Dir(path), "accounts"), false)
+}
 
-	_, err = db.Exec(createContactsTableSQL)
-	if err != nil {
-		log.Fatal(err)
+// newSQLiteStore brings the main database up to date and wraps it in a store
+func newSQLiteStore(conn *sql.DB, path, accountDir string, memory bool) (*SQLiteStore, error) {
+	if err := migrate(conn); err != nil {
+		conn.Close()
+		return nil, err
 	}
+	return &SQLiteStore{
+		db:         conn,
+		path:       path,
+		accountDir: accountDir,
+		memory:     memory,
+		accountDBs: make(map[int]*sql.DB),
+	}, nil
+}
 
-	_, err = db.Exec(createMessagesTableSQL)
-	if err != nil {
-		log.Fatal(err)
+// Close locks every unlocked account and closes the main database
+func (s *SQLiteStore) Close() error {
+	s.accountDBsMu.Lock()
+	for userID, conn := range s.accountDBs {
+		conn.Close()
+		delete(s.accountDBs, userID)
 	}
+	s.accountDBsMu.Unlock()
+	return s.db.Close()
+}
+
+// TransportPluginSetting holds the ClientTransportPlugin path used with bridges
+const TransportPluginSetting = "transportPlugin"
+
+// Bridge struct to hold a tor bridge line
+type Bridge struct {
+	ID   int
+	Line string
 }
 
 // Message struct to hold message information
 type Message struct {
+	ID        int
 	Sender    string
 	Receiver  string
 	Message   []byte
 	Timestamp string
+	// Verified is set when the message was signed by the sender, messages from before signing aren't
+	Verified bool
+	// State is the delivery state of a sent message, see MessageQueued
+	State string
+	// UUID, SentAt and Seq are set by the sender. Seq counts the sender's messages in the conversation.
+	// Messages from before they were introduced have none of them.
+	UUID   string
+	SentAt int64
+	Seq    int
+	// DeliveredAt and ReadAt come from the receiver's receipts, on received messages ReadAt is when the owner read it
+	DeliveredAt int64
+	ReadAt      int64
+	// GroupID is set on group messages, their receiver is the group
+	GroupID string
+	// Outgoing is set on the messages the account sent, usernames can't tell as contacts choose their own
+	Outgoing bool
+}
+
+// UserRow struct to hold an account as the user table stores it, its secrets are encrypted
+type UserRow struct {
+	ID              int
+	Username        string
+	Password        string
+	PrivateKey      []byte
+	PublicKey       []byte
+	OnionAddress    string
+	TorrcFilePath   string
+	OnionPrivateKey []byte
+	KDFParams       string
 }
 
-// SaveUser saves a user to the database
-func SaveUser(username, password string, privateKey, publicKey []byte, onionAddress, torrcFilePath string) error {
-	insertUserSQL := `INSERT INTO user (username, password, privateKey, publicKey, onionAddress, torrcFilePath) VALUES (?, ?, ?, ?, ?, ?)`
-	statement, err := db.Prepare(insertUserSQL)
+// SaveUser saves a user to the database and returns the account's ID
+func (s *SQLiteStore) SaveUser(u UserRow) (int, error) {
+	insertUserSQL := `INSERT INTO user (username, password, privateKey, publicKey, onionAddress, torrcFilePath, onionPrivateKey, kdfParams) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`
+	statement, err := s.db.Prepare(insertUserSQL)
 	if err != nil {
-		return err
+		return 0, err
 	}
-	_, err = statement.Exec(username, password, privateKey, publicKey, onionAddress, torrcFilePath)
+	result, err := statement.Exec(u.Username, u.Password, u.PrivateKey, u.PublicKey, u.OnionAddress, u.TorrcFilePath, u.OnionPrivateKey, u.KDFParams)
 	if err != nil {
 		log.Println("Error saving user:", err) // Debug print
+		return 0, err
 	}
-	return err
+	id, err := result.LastInsertId()
+	return int(id), err
 }
 
-// GetUser retrieves a user by username
-func GetUser(username string) (string, string, []byte, []byte, string, string, error) {
-	row := db.QueryRow("SELECT username, password, privateKey, publicKey, onionAddress, torrcFilePath FROM user WHERE username = ?", username)
+// GetUser retrieves a user and the account's ID by username, ErrNotFound if there is none
+func (s *SQLiteStore) GetUser(username string) (UserRow, error) {
+	var u UserRow
+	var kdfParams sql.NullString
+	row := s.db.QueryRow("SELECT id, username, password, privateKey, publicKey, onionAddress, torrcFilePath, onionPrivateKey, kdfParams FROM user WHERE username = ?", username)
+	err := row.Scan(&u.ID, &u.Username, &u.Password, &u.PrivateKey, &u.PublicKey, &u.OnionAddress, &u.TorrcFilePath, &u.OnionPrivateKey, &kdfParams)
+	u.KDFParams = kdfParams.String
+	return u, notFound(err)
+}
+
+// notFound turns the error of a lookup that found no row into ErrNotFound
+func notFound(err error) error {
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrNotFound
+	}
+	return err
+}
 
-	var (
-		uUsername      string
-		uPassword      string
-		uOnionAddress  string
-		uPrivateKey    []byte
-		uPublicKey     []byte
-		uTorrcFilePath string
-	)
-	err := row.Scan(&uUsername, &uPassword, &uPrivateKey, &uPublicKey, &uOnionAddress, &uTorrcFilePath)
+// GetKDFParams retrieves the parameters of the key that encrypts a user's secrets.
+// Accounts from before Argon2id return an empty string.
+func (s *SQLiteStore) GetKDFParams(username string) (string, error) {
+	var kdfParams sql.NullString
+	err := s.db.QueryRow("SELECT kdfParams FROM user WHERE username = ?", username).Scan(&kdfParams)
 	if err != nil {
-		return "", "", nil, nil, "", "", err
+		return "", notFound(err)
 	}
-	return uUsername, uPassword, uPrivateKey, uPublicKey, uOnionAddress, uTorrcFilePath, nil
+	return kdfParams.String, nil
 }
 
-// SaveContact saves a contact to the database
-func SaveContact(username, contactUsername, contactOnionAddress string, contactPublicKey []byte) error {
-	c, err := GetContactByUsername(contactUsername)
+// UpdateUserKeys replaces a user's password hash, KDF parameters and every secret
+// encrypted with the old key in one transaction. It only runs for accounts from before Argon2id,
+// whose messages are still in localDB.db because they never had a data key.
+func (s *SQLiteStore) UpdateUserKeys(username, password, kdfParams string, privateKey, onionPrivateKey []byte, sentMessages []Message) error {
+	tx, err := s.db.Begin()
 	if err != nil {
-		return nil
+		return err
 	}
-	if username == contactUsername {
-		// Check if username is the same as contactUsername
-		return nil
-	} else if c.Username == contactUsername {
-		// Check if contactUsername is already in the database
-		fmt.Println("Contact already exists")
-		return nil
-	} else {
-		insertContactSQL := `INSERT INTO contacts (username, contactUsername, contactOnionAddress, contactPublicKey) VALUES (?, ?, ?, ?)`
-		statement, err := db.Prepare(insertContactSQL)
+	defer tx.Rollback()
+
+	_, err = tx.Exec("UPDATE user SET password = ?, kdfParams = ?, privateKey = ?, onionPrivateKey = ? WHERE username = ?", password, kdfParams, privateKey, onionPrivateKey, username)
+	if err != nil {
+		return err
+	}
+	for _, msg := range sentMessages {
+		_, err = tx.Exec("UPDATE messages SET message = ? WHERE id = ? AND userId = (SELECT id FROM user WHERE username = ?)", msg.Message, msg.ID, username)
 		if err != nil {
 			return err
 		}
-		_, err = statement.Exec(username, contactUsername, contactOnionAddress, contactPublicKey)
+	}
+	return tx.Commit()
+}
+
+// GetSentMessages retrieves every message an account sent that is still in localDB.db,
+// they are encrypted with the account's own key
+func (s *SQLiteStore) GetSentMessages(userID int) ([]Message, error) {
+	rows, err := s.db.Query("SELECT id, sender, receiver, message, timestamp FROM messages WHERE userId = ? AND outgoing = 1", userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var messages []Message
+	for rows.Next() {
+		var msg Message
+		err := rows.Scan(&msg.ID, &msg.Sender, &msg.Receiver, &msg.Message, &msg.Timestamp)
+		if err != nil {
+			return nil, err
+		}
+		messages = append(messages, msg)
+	}
+	return messages, rows.Err()
+}
+
+// GetOnionPrivateKey retrieves the encrypted onion service key of a user.
+// Accounts created before keys were stored in the database return nil.
+func (s *SQLiteStore) GetOnionPrivateKey(username string) ([]byte, error) {
+	var onionPrivateKey []byte
+	err := s.db.QueryRow("SELECT onionPrivateKey FROM user WHERE username = ?", username).Scan(&onionPrivateKey)
+	if err != nil {
+		return nil, notFound(err)
+	}
+	return onionPrivateKey, nil
+}
+
+// UpdateOnionPrivateKey stores the encrypted onion service key and the torrc file of a user
+func (s *SQLiteStore) UpdateOnionPrivateKey(username string, onionPrivateKey []byte, torrcFilePath string) error {
+	_, err := s.db.Exec("UPDATE user SET onionPrivateKey = ?, torrcFilePath = ? WHERE username = ?", onionPrivateKey, torrcFilePath, username)
+	return err
+}
+
+// GetTorPorts retrieves the SocksPort, ControlPort and onion service port of a user.
+// Ports that were never allocated are 0.
+func (s *SQLiteStore) GetTorPorts(username string) (int, int, int, error) {
+	var socksPort, controlPort, servicePort int
+	err := s.db.QueryRow("SELECT socksPort, controlPort, servicePort FROM user WHERE username = ?", username).Scan(&socksPort, &controlPort, &servicePort)
+	if err != nil {
+		return 0, 0, 0, notFound(err)
+	}
+	return socksPort, controlPort, servicePort, nil
+}
+
+// UpdateTorPorts stores the ports allocated for a user's tor
+func (s *SQLiteStore) UpdateTorPorts(username string, socksPort, controlPort, servicePort int) error {
+	_, err := s.db.Exec("UPDATE user SET socksPort = ?, controlPort = ?, servicePort = ? WHERE username = ?", socksPort, controlPort, servicePort, username)
+	return err
+}
+
+// ErrContactConflict is returned when an onion address is already saved for a contact with another key
+var ErrContactConflict = errors.New("a contact with another key already uses this onion address")
+
+// SaveContact saves a contact of an account and returns it. A contact is identified by its key's fingerprint
+// and its onion address, saving the same one again returns the stored contact. The contact's username
+// becomes its nickname, with a number appended if another contact already has that nickname.
+func (s *SQLiteStore) SaveContact(userID int, contactUsername, contactOnionAddress string, contactPublicKey []byte) (user.Contact, error) {
+	conn, err := s.accountDB(userID)
+	if err != nil {
+		return user.Contact{}, err
+	}
+	fingerprint, err := user.Fingerprint(contactPublicKey)
+	if err != nil {
+		return user.Contact{}, err
+	}
+
+	tx, err := conn.Begin()
+	if err != nil {
+		return user.Contact{}, err
+	}
+	defer tx.Rollback()
+
+	var username, onionAddress string
+	if err := tx.QueryRow("SELECT username, onionAddress FROM user WHERE id = ?", userID).Scan(&username, &onionAddress); err != nil {
+		return user.Contact{}, err
+	}
+	if onionAddress == contactOnionAddress {
+		return user.Contact{}, errors.New("an account can't be its own contact")
+	}
+
+	existing, err := scanContact(tx.QueryRow("SELECT "+contactColumns+" FROM contacts WHERE userId = ? AND contactOnionAddress = ?", userID, contactOnionAddress))
+	if err == nil {
+		if existing.Fingerprint != fingerprint {
+			return user.Contact{}, ErrContactConflict
+		}
+		fmt.Println("Contact already exists") // Debug print
+		return existing, nil
+	} else if !errors.Is(err, ErrNotFound) {
+		return user.Contact{}, err
+	}
+
+	nickname, err := uniqueNickname(tx, userID, username, contactUsername)
+	if err != nil {
+		return user.Contact{}, err
+	}
+	result, err := tx.Exec(`INSERT INTO contacts (userId, username, contactUsername, contactOnionAddress, contactPublicKey, fingerprint, nickname) VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		userID, username, contactUsername, contactOnionAddress, contactPublicKey, fingerprint, nickname)
+	if err != nil {
+		return user.Contact{}, err
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return user.Contact{}, err
+	}
+	contact := user.Contact{
+		ID:           int(id),
+		Username:     contactUsername,
+		OnionAddress: contactOnionAddress,
+		PublicKey:    contactPublicKey,
+		Fingerprint:  fingerprint,
+		Nickname:     nickname,
+	}
+	return contact, tx.Commit()
+}
+
+// queryer is a database or a transaction
+type queryer interface {
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// uniqueNickname returns name, or name with a number appended, that no other contact of the account has.
+// It is never the account's own username, so clients can tell the account's messages from the contact's.
+func uniqueNickname(q queryer, userID int, ownUsername, name string) (string, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		name = "contact"
+	}
+	candidate := name
+	for i := 2; ; i++ {
+		var taken bool
+		err := q.QueryRow("SELECT EXISTS (SELECT 1 FROM contacts WHERE userId = ? AND nickname = ?)", userID, candidate).Scan(&taken)
+		if err != nil {
+			return "", err
+		}
+		if !taken && candidate != ownUsername {
+			return candidate, nil
+		}
+		candidate = fmt.Sprintf("%s-%d", name, i)
+	}
+}
+
+// RenameContact changes the nickname an account gave a contact
+func (s *SQLiteStore) RenameContact(userID, contactID int, nickname string) error {
+	conn, err := s.accountDB(userID)
+	if err != nil {
+		return err
+	}
+	nickname = strings.TrimSpace(nickname)
+	if nickname == "" {
+		return errors.New("the nickname is empty")
+	}
+	var username string
+	if err := conn.QueryRow("SELECT username FROM user WHERE id = ?", userID).Scan(&username); err != nil {
 		return err
 	}
+	if nickname == username {
+		return errors.New("a contact can't have the account's own username as nickname")
+	}
+	var taken bool
+	err = conn.QueryRow("SELECT EXISTS (SELECT 1 FROM contacts WHERE userId = ? AND nickname = ? AND id != ?)", userID, nickname, contactID).Scan(&taken)
+	if err != nil {
+		return err
+	}
+	if taken {
+		return errors.New("another contact already has the nickname " + nickname)
+	}
+	_, err = conn.Exec("UPDATE contacts SET nickname = ? WHERE userId = ? AND id = ?", nickname, userID, contactID)
+	return err
 }
 
-// GetAllContacts retrieves all contacts from the database
-func GetAllContacts() ([]user.Contact, error) {
-	rows, err := db.Query("SELECT username, contactUsername, contactOnionAddress, contactPublicKey FROM contacts")
+// contactColumns are the columns scanContact reads
+const contactColumns = "id, contactUsername, contactOnionAddress, contactPublicKey, fingerprint, nickname"
+
+// scanContact reads a row of a query that selects contactColumns
+func scanContact(row interface{ Scan(...interface{}) error }) (user.Contact, error) {
+	var contact user.Contact
+	var contactUsername, contactOnionAddress, fingerprint, nickname sql.NullString
+	err := row.Scan(&contact.ID, &contactUsername, &contactOnionAddress, &contact.PublicKey, &fingerprint, &nickname)
+	contact.Username = contactUsername.String
+	contact.OnionAddress = contactOnionAddress.String
+	contact.Fingerprint = fingerprint.String
+	contact.Nickname = nickname.String
+	return contact, notFound(err)
+}
+
+// GetContacts retrieves the contacts of an account
+func (s *SQLiteStore) GetContacts(userID int) ([]user.Contact, error) {
+	conn, err := s.accountDB(userID)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := conn.Query("SELECT "+contactColumns+" FROM contacts WHERE userId = ? ORDER BY id", userID)
 	if err != nil {
 		log.Println("Error querying contacts:", err) // Debug print
 		return nil, err
@@ -142,80 +383,254 @@ func GetAllContacts() ([]user.Contact, error) {
 
 	var contacts []user.Contact
 	for rows.Next() {
-		var contact user.Contact
-		var username sql.NullString
-		var contactUsername sql.NullString
-		var contactOnionAddress sql.NullString
-		var contactPublicKey []byte
-
-		err := rows.Scan(&username, &contactUsername, &contactOnionAddress, &contactPublicKey)
+		contact, err := scanContact(rows)
 		if err != nil {
 			log.Println("Error scanning contact:", err) // Debug print
 			return nil, err
 		}
+		contacts = append(contacts, contact)
+	}
+	return contacts, rows.Err()
+}
 
-		contact.Username = contactUsername.String
-		contact.OnionAddress = contactOnionAddress.String
-		contact.PublicKey = contactPublicKey
+// GetContact retrieves a contact of an account by its nickname or key fingerprint, ErrNotFound if there is none
+func (s *SQLiteStore) GetContact(userID int, nicknameOrFingerprint string) (user.Contact, error) {
+	conn, err := s.accountDB(userID)
+	if err != nil {
+		return user.Contact{}, err
+	}
+	return scanContact(conn.QueryRow("SELECT "+contactColumns+" FROM contacts WHERE userId = ? AND (nickname = ? OR fingerprint = LOWER(?)) ORDER BY nickname = ? DESC LIMIT 1",
+		userID, nicknameOrFingerprint, nicknameOrFingerprint, nicknameOrFingerprint))
+}
 
-		contacts = append(contacts, contact)
+// GetContactByOnionAddress retrieves the contact of an account that has an onion address, ErrNotFound if there is none
+func (s *SQLiteStore) GetContactByOnionAddress(userID int, onionAddress string) (user.Contact, error) {
+	conn, err := s.accountDB(userID)
+	if err != nil {
+		return user.Contact{}, err
 	}
-	return contacts, nil
+	return scanContact(conn.QueryRow("SELECT "+contactColumns+" FROM contacts WHERE userId = ? AND contactOnionAddress = ?", userID, onionAddress))
 }
 
-// GetContactByUsername retrieves specified contact from the database
-func GetContactByUsername(username string) (user.Contact, error) {
-	var contact user.Contact
+// Directions of a contact request
+const (
+	OutgoingContactRequest = "outgoing"
+	IncomingContactRequest = "incoming"
+)
 
-	row := db.QueryRow("SELECT contactUsername, contactOnionAddress, contactPublicKey FROM contacts WHERE contactUsername = ?", username)
+// States of a contact request. An accepted incoming request is kept until the reply is delivered.
+const (
+	ContactRequestPending  = "pending"
+	ContactRequestAccepted = "accepted"
+)
+
+// ContactRequest struct to hold a contact request between a user and an onion address
+type ContactRequest struct {
+	ID              int
+	OnionAddress    string
+	Direction       string
+	Status          string
+	ContactUsername string
+	PublicKey       []byte
+	Created         string
+}
 
-	var contactUsername string
-	var contactOnionAddress string
-	var contactPublicKey []byte
+// SaveContactRequest records a contact request between a user and an onion address.
+// Incoming requests carry the requester's username and public key.
+func (s *SQLiteStore) SaveContactRequest(userID int, onionAddress, direction, contactUsername string, contactPublicKey []byte) error {
+	conn, err := s.accountDB(userID)
+	if err != nil {
+		return err
+	}
+	_, err = conn.Exec("INSERT OR IGNORE INTO contact_requests (userId, onionAddress, direction, contactUsername, contactPublicKey) VALUES (?, ?, ?, ?, ?)", userID, onionAddress, direction, contactUsername, contactPublicKey)
+	return err
+}
 
-	err := row.Scan(&contactUsername, &contactOnionAddress, &contactPublicKey)
+// GetContactRequests retrieves a user's contact requests of a direction and state
+func (s *SQLiteStore) GetContactRequests(userID int, direction, status string) ([]ContactRequest, error) {
+	conn, err := s.accountDB(userID)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := conn.Query("SELECT id, onionAddress, direction, status, contactUsername, contactPublicKey, created FROM contact_requests WHERE userId = ? AND direction = ? AND status = ? ORDER BY id", userID, direction, status)
 	if err != nil {
-		if err == sql.ErrNoRows {
-			log.Println("No contact found for username:", username) // Debug print
-			return contact, nil                                     // Return an empty contact and no error
+		return nil, err
+	}
+	defer rows.Close()
+
+	var requests []ContactRequest
+	for rows.Next() {
+		var req ContactRequest
+		var contactUsername sql.NullString
+		err := rows.Scan(&req.ID, &req.OnionAddress, &req.Direction, &req.Status, &contactUsername, &req.PublicKey, &req.Created)
+		if err != nil {
+			return nil, err
 		}
-		log.Println("Error scanning contact:", err) // Debug print
-		return contact, err
+		req.ContactUsername = contactUsername.String
+		requests = append(requests, req)
+	}
+	return requests, rows.Err()
+}
+
+// GetContactRequest retrieves one of a user's contact requests by its ID
+func (s *SQLiteStore) GetContactRequest(userID, id int) (ContactRequest, error) {
+	conn, err := s.accountDB(userID)
+	if err != nil {
+		return ContactRequest{}, err
+	}
+	var req ContactRequest
+	var contactUsername sql.NullString
+	row := conn.QueryRow("SELECT id, onionAddress, direction, status, contactUsername, contactPublicKey, created FROM contact_requests WHERE userId = ? AND id = ?", userID, id)
+	err = row.Scan(&req.ID, &req.OnionAddress, &req.Direction, &req.Status, &contactUsername, &req.PublicKey, &req.Created)
+	req.ContactUsername = contactUsername.String
+	return req, notFound(err)
+}
+
+// SetContactRequestStatus updates the state of a contact request
+func (s *SQLiteStore) SetContactRequestStatus(userID, id int, status string) error {
+	conn, err := s.accountDB(userID)
+	if err != nil {
+		return err
 	}
+	_, err = conn.Exec("UPDATE contact_requests SET status = ? WHERE userId = ? AND id = ?", status, userID, id)
+	return err
+}
 
-	contact.Username = contactUsername
-	contact.OnionAddress = contactOnionAddress
-	contact.PublicKey = contactPublicKey
-	return contact, nil
+// HasContactRequest reports whether a contact request between a user and an onion address is open
+func (s *SQLiteStore) HasContactRequest(userID int, onionAddress, direction string) (bool, error) {
+	conn, err := s.accountDB(userID)
+	if err != nil {
+		return false, err
+	}
+	var count int
+	err = conn.QueryRow("SELECT COUNT(*) FROM contact_requests WHERE userId = ? AND onionAddress = ? AND direction = ?", userID, onionAddress, direction).Scan(&count)
+	return count > 0, err
 }
 
-// GetMessages retrieves messages between two users from the database
-func GetMessages(sender, receiver string) ([]Message, error) {
-	rows, err := db.Query("SELECT sender, receiver, message, timestamp FROM messages WHERE (sender = ? AND receiver = ?) OR (sender = ? AND receiver = ?)", sender, receiver, receiver, sender)
+// DeleteContactRequest removes a contact request once it has been answered
+func (s *SQLiteStore) DeleteContactRequest(userID int, onionAddress, direction string) error {
+	conn, err := s.accountDB(userID)
+	if err != nil {
+		return err
+	}
+	_, err = conn.Exec("DELETE FROM contact_requests WHERE userId = ? AND onionAddress = ? AND direction = ?", userID, onionAddress, direction)
+	return err
+}
+
+// GetMessages retrieves the messages of an account's conversation with a contact, in the order they were sent
+func (s *SQLiteStore) GetMessages(userID, contactID int) ([]Message, error) {
+	conn, err := s.accountDB(userID)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := conn.Query(`SELECT `+messageColumns+` FROM messages
+        WHERE userId = ? AND contactId = ? AND groupId IS NULL
+        ORDER BY COALESCE(sentAt, CAST(strftime('%s', timestamp) AS INTEGER)), id`, userID, contactID)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
+	return scanMessages(rows)
+}
+
+// messageColumns are the columns scanMessages reads
+const messageColumns = "id, sender, receiver, message, timestamp, verified, state, uuid, sentAt, seq, deliveredAt, readAt, groupId, outgoing"
 
+// scanMessages reads the rows of a query that selects messageColumns
+func scanMessages(rows *sql.Rows) ([]Message, error) {
 	var messages []Message
 	for rows.Next() {
 		var msg Message
-		err := rows.Scan(&msg.Sender, &msg.Receiver, &msg.Message, &msg.Timestamp)
+		var uuid, groupID sql.NullString
+		var sentAt, seq, deliveredAt, readAt sql.NullInt64
+		err := rows.Scan(&msg.ID, &msg.Sender, &msg.Receiver, &msg.Message, &msg.Timestamp, &msg.Verified, &msg.State, &uuid, &sentAt, &seq, &deliveredAt, &readAt, &groupID, &msg.Outgoing)
 		if err != nil {
 			return nil, err
 		}
+		msg.UUID = uuid.String
+		msg.SentAt = sentAt.Int64
+		msg.Seq = int(seq.Int64)
+		msg.DeliveredAt = deliveredAt.Int64
+		msg.ReadAt = readAt.Int64
+		msg.GroupID = groupID.String
 		messages = append(messages, msg)
 	}
-	return messages, nil
+	return messages, rows.Err()
 }
 
-// SaveMessage saves a message to the database with a timestamp
-func SaveMessage(sender, receiver string, message []byte) error {
-	insertMessageSQL := `INSERT INTO messages (sender, receiver, message, timestamp) VALUES (?, ?, ?, CURRENT_TIMESTAMP)`
-	statement, err := db.Prepare(insertMessageSQL)
+// SaveMessage saves a message the account received to the database with a timestamp.
+// It reports false if the message was already stored.
+func (s *SQLiteStore) SaveMessage(userID, contactID int, sender, receiver string, message []byte, verified bool, uuid string, sentAt int64, seq int) (bool, error) {
+	conn, err := s.accountDB(userID)
 	if err != nil {
+		return false, err
+	}
+	insertMessageSQL := `INSERT OR IGNORE INTO messages (userId, contactId, sender, receiver, message, timestamp, verified, owner, uuid, sentAt, seq) VALUES (?, ?, ?, ?, ?, CURRENT_TIMESTAMP, ?, ?, ?, ?, ?)`
+	statement, err := conn.Prepare(insertMessageSQL)
+	if err != nil {
+		return false, err
+	}
+	result, err := statement.Exec(userID, contactID, sender, receiver, message, verified, receiver, uuid, sentAt, seq)
+	if err != nil {
+		return false, err
+	}
+	inserted, err := result.RowsAffected()
+	return inserted > 0, err
+}
+
+// SaveBridge saves a bridge line, lines that are already stored are ignored
+func (s *SQLiteStore) SaveBridge(line string) error {
+	_, err := s.db.Exec("INSERT OR IGNORE INTO bridges (line) VALUES (?)", line)
+	return err
+}
+
+// GetBridges retrieves every stored bridge line
+func (s *SQLiteStore) GetBridges() ([]Bridge, error) {
+	rows, err := s.db.Query("SELECT id, line FROM bridges ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var bridges []Bridge
+	for rows.Next() {
+		var bridge Bridge
+		if err := rows.Scan(&bridge.ID, &bridge.Line); err != nil {
+			return nil, err
+		}
+		bridges = append(bridges, bridge)
+	}
+	return bridges, rows.Err()
+}
+
+// DeleteBridge removes a bridge line by its id
+func (s *SQLiteStore) DeleteBridge(id int) error {
+	result, err := s.db.Exec("DELETE FROM bridges WHERE id = ?", id)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return fmt.Errorf("no bridge with id %d", id)
+	}
+	return nil
+}
+
+// GetSetting retrieves a setting, unset settings are empty
+func (s *SQLiteStore) GetSetting(key string) (string, error) {
+	var value string
+	err := s.db.QueryRow("SELECT value FROM settings WHERE key = ?", key).Scan(&value)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return value, err
+}
+
+// SetSetting stores a setting, an empty value removes it
+func (s *SQLiteStore) SetSetting(key, value string) error {
+	if value == "" {
+		_, err := s.db.Exec("DELETE FROM settings WHERE key = ?", key)
 		return err
 	}
-	_, err = statement.Exec(sender, receiver, message)
+	_, err := s.db.Exec("INSERT INTO settings (key, value) VALUES (?, ?) ON CONFLICT(key) DO UPDATE SET value = excluded.value", key, value)
 	return err
 }
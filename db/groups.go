@@ -0,0 +1,265 @@
+package db
+
+import (
+	"database/sql"
+	"time"
+)
+
+// Group struct to hold a group chat as one account knows it
+type Group struct {
+	GroupID string
+	Name    string
+	// The creator signs every version of the member list, only they can change it
+	CreatorOnionAddress string
+	CreatorPublicKey    []byte
+	Version             int
+	Members             []GroupMember
+}
+
+// GroupMember struct to hold a member of a group
+type GroupMember struct {
+	Username     string
+	OnionAddress string
+	PublicKey    []byte
+}
+
+// QueuedGroupUpdate struct to hold a signed member list waiting for delivery to a member
+type QueuedGroupUpdate struct {
+	ID           int
+	OnionAddress string
+	Payload      []byte
+	Attempts     int
+	Expires      time.Time
+
+	// userID is the account the update belongs to
+	userID int
+}
+
+// SaveGroup stores a version of a group for an account and replaces its member list.
+// membership and signature are the creator's signed member list the version comes from.
+func (s *SQLiteStore) SaveGroup(userID int, group Group, membership, signature []byte) error {
+	conn, err := s.accountDB(userID)
+	if err != nil {
+		return err
+	}
+	tx, err := conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`INSERT INTO chat_groups (userId, groupId, name, creatorOnionAddress, creatorPublicKey, version, membership, signature) VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+        ON CONFLICT(userId, groupId) DO UPDATE SET name = excluded.name, version = excluded.version, membership = excluded.membership, signature = excluded.signature`,
+		userID, group.GroupID, group.Name, group.CreatorOnionAddress, group.CreatorPublicKey, group.Version, membership, signature)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("DELETE FROM group_members WHERE userId = ? AND groupId = ?", userID, group.GroupID)
+	if err != nil {
+		return err
+	}
+	for _, member := range group.Members {
+		_, err = tx.Exec("INSERT INTO group_members (userId, groupId, username, onionAddress, publicKey) VALUES (?, ?, ?, ?, ?)",
+			userID, group.GroupID, member.Username, member.OnionAddress, member.PublicKey)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// GetGroup retrieves a group of an account with its members, ErrNotFound if the account isn't in it
+func (s *SQLiteStore) GetGroup(userID int, groupID string) (Group, error) {
+	conn, err := s.accountDB(userID)
+	if err != nil {
+		return Group{}, err
+	}
+	var group Group
+	err = conn.QueryRow("SELECT groupId, name, creatorOnionAddress, creatorPublicKey, version FROM chat_groups WHERE userId = ? AND groupId = ?", userID, groupID).
+		Scan(&group.GroupID, &group.Name, &group.CreatorOnionAddress, &group.CreatorPublicKey, &group.Version)
+	if err != nil {
+		return group, notFound(err)
+	}
+	group.Members, err = getGroupMembers(conn, userID, groupID)
+	return group, err
+}
+
+// GetGroups retrieves the groups of an account with their members
+func (s *SQLiteStore) GetGroups(userID int) ([]Group, error) {
+	conn, err := s.accountDB(userID)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := conn.Query("SELECT groupId, name, creatorOnionAddress, creatorPublicKey, version FROM chat_groups WHERE userId = ? ORDER BY id", userID)
+	if err != nil {
+		return nil, err
+	}
+	var groups []Group
+	for rows.Next() {
+		var group Group
+		if err := rows.Scan(&group.GroupID, &group.Name, &group.CreatorOnionAddress, &group.CreatorPublicKey, &group.Version); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		groups = append(groups, group)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for i := range groups {
+		groups[i].Members, err = getGroupMembers(conn, userID, groups[i].GroupID)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return groups, nil
+}
+
+// getGroupMembers retrieves the member list of a group
+func getGroupMembers(conn *sql.DB, userID int, groupID string) ([]GroupMember, error) {
+	rows, err := conn.Query("SELECT username, onionAddress, publicKey FROM group_members WHERE userId = ? AND groupId = ? ORDER BY id", userID, groupID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var members []GroupMember
+	for rows.Next() {
+		var member GroupMember
+		if err := rows.Scan(&member.Username, &member.OnionAddress, &member.PublicKey); err != nil {
+			return nil, err
+		}
+		members = append(members, member)
+	}
+	return members, rows.Err()
+}
+
+// GetGroupMember retrieves a member of a group by onion address, ErrNotFound if they aren't in it
+func (s *SQLiteStore) GetGroupMember(userID int, groupID, onionAddress string) (GroupMember, error) {
+	conn, err := s.accountDB(userID)
+	if err != nil {
+		return GroupMember{}, err
+	}
+	var member GroupMember
+	err = conn.QueryRow("SELECT username, onionAddress, publicKey FROM group_members WHERE userId = ? AND groupId = ? AND onionAddress = ?", userID, groupID, onionAddress).
+		Scan(&member.Username, &member.OnionAddress, &member.PublicKey)
+	return member, notFound(err)
+}
+
+// DeleteGroup removes a group an account was removed from, its messages are kept
+func (s *SQLiteStore) DeleteGroup(userID int, groupID string) error {
+	conn, err := s.accountDB(userID)
+	if err != nil {
+		return err
+	}
+	tx, err := conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec("DELETE FROM group_members WHERE userId = ? AND groupId = ?", userID, groupID)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("DELETE FROM chat_groups WHERE userId = ? AND groupId = ?", userID, groupID)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// GetGroupMessages retrieves the messages of an account's group conversation, in the order they were sent
+func (s *SQLiteStore) GetGroupMessages(userID int, groupID string) ([]Message, error) {
+	conn, err := s.accountDB(userID)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := conn.Query(`SELECT `+messageColumns+` FROM messages
+        WHERE userId = ? AND groupId = ?
+        ORDER BY COALESCE(sentAt, CAST(strftime('%s', timestamp) AS INTEGER)), id`, userID, groupID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return scanMessages(rows)
+}
+
+// SaveGroupMessage saves a message a member sent to a group, sender is the member's key fingerprint.
+// It reports false if the message was already stored.
+func (s *SQLiteStore) SaveGroupMessage(userID int, owner, sender, groupID string, message []byte, uuid string, sentAt int64, seq int) (bool, error) {
+	conn, err := s.accountDB(userID)
+	if err != nil {
+		return false, err
+	}
+	result, err := conn.Exec(`INSERT OR IGNORE INTO messages (userId, sender, receiver, message, timestamp, verified, owner, uuid, sentAt, seq, groupId) VALUES (?, ?, ?, ?, CURRENT_TIMESTAMP, 1, ?, ?, ?, ?, ?)`,
+		userID, sender, groupID, message, owner, uuid, sentAt, seq, groupID)
+	if err != nil {
+		return false, err
+	}
+	inserted, err := result.RowsAffected()
+	return inserted > 0, err
+}
+
+// QueueGroupUpdate saves a signed member list for delivery to a member
+func (s *SQLiteStore) QueueGroupUpdate(userID int, onionAddress string, payload []byte, expires time.Time) error {
+	conn, err := s.accountDB(userID)
+	if err != nil {
+		return err
+	}
+	_, err = conn.Exec("INSERT INTO group_updates (userId, onionAddress, payload, expires) VALUES (?, ?, ?, ?)", userID, onionAddress, payload, expires.Unix())
+	return err
+}
+
+// GetDueGroupUpdates retrieves the queued member lists of a user whose next attempt is due
+func (s *SQLiteStore) GetDueGroupUpdates(userID int, now time.Time) ([]QueuedGroupUpdate, error) {
+	conn, err := s.accountDB(userID)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := conn.Query("SELECT id, onionAddress, payload, attempts, expires FROM group_updates WHERE userId = ? AND nextAttempt <= ? ORDER BY id", userID, now.Unix())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var updates []QueuedGroupUpdate
+	for rows.Next() {
+		update := QueuedGroupUpdate{userID: userID}
+		var expires int64
+		err := rows.Scan(&update.ID, &update.OnionAddress, &update.Payload, &update.Attempts, &expires)
+		if err != nil {
+			return nil, err
+		}
+		update.Expires = time.Unix(expires, 0)
+		updates = append(updates, update)
+	}
+	return updates, rows.Err()
+}
+
+// RetryGroupUpdate records a failed delivery attempt of a member list and when to try again
+func (s *SQLiteStore) RetryGroupUpdate(update QueuedGroupUpdate, nextAttempt time.Time) error {
+	conn, err := s.accountDB(update.userID)
+	if err != nil {
+		return err
+	}
+	_, err = conn.Exec("UPDATE group_updates SET attempts = attempts + 1, nextAttempt = ? WHERE id = ?", nextAttempt.Unix(), update.ID)
+	return err
+}
+
+// DeleteGroupUpdate removes a member list that was delivered or given up on
+func (s *SQLiteStore) DeleteGroupUpdate(update QueuedGroupUpdate) error {
+	conn, err := s.accountDB(update.userID)
+	if err != nil {
+		return err
+	}
+	_, err = conn.Exec("DELETE FROM group_updates WHERE id = ?", update.ID)
+	return err
+}
+
+// nullString stores an empty string as NULL
+func nullString(s string) sql.NullString {
+	return sql.NullString{String: s, Valid: s != ""}
+}
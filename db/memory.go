@@ -0,0 +1,26 @@
+package db
+
+import "database/sql"
+
+// NewMemoryStore returns a store that keeps every database in memory, so the node can run without files.
+// Its data is gone once it is closed.
+func NewMemoryStore() (*SQLiteStore, error) {
+	conn, err := openMemoryDB()
+	if err != nil {
+		return nil, err
+	}
+	return newSQLiteStore(conn, ":memory:", "", true)
+}
+
+// openMemoryDB opens an empty database in memory
+func openMemoryDB() (*sql.DB, error) {
+	conn, err := sql.Open("sqlite3", ":memory:?_foreign_keys=on")
+	if err != nil {
+		return nil, err
+	}
+	// Every connection to :memory: has a database of its own, they must all use the same one
+	conn.SetMaxOpenConns(1)
+	conn.SetConnMaxLifetime(0)
+	conn.SetConnMaxIdleTime(0)
+	return conn, nil
+}
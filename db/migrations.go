@@ -0,0 +1,455 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"sote/user"
+)
+
+// ErrNewerSchema is returned when the database was migrated by a newer version of sote
+var ErrNewerSchema = errors.New("database schema is newer than this version of sote")
+
+// migration changes the schema from the previous version to its version
+type migration struct {
+	version int
+	name    string
+	up      func(tx *sql.Tx) error
+}
+
+// migrations are applied in order at Initialize, each in its own transaction.
+// Databases from before schema_version existed start at version 0 in any older state,
+// which is why the first migrations only add what is missing. Append new migrations
+// at the end and never change one that was released.
+var migrations = []migration{
+	{1, "create tables", createTables},
+	{2, "add columns of older tables", addOlderColumns},
+	{3, "set message owners", setMessageOwners},
+	{4, "reference accounts by ID", referenceAccounts},
+	{5, "identify contacts by key", identifyContacts},
+	{6, "index messages by conversation", indexMessages},
+	{7, "add account data keys", addDataKeys},
+	{8, "scope message IDs to conversations", scopeMessageIDs},
+	{9, "reference accounts by ID in queues and groups", referenceAccountsEverywhere},
+	{10, "record message direction", recordMessageDirection},
+	{11, "keep retried messages queued", requeueRetriedMessages},
+}
+
+// SchemaVersion is the schema version this version of sote migrates databases to
+func SchemaVersion() int {
+	return migrations[len(migrations)-1].version
+}
+
+// migrate brings a database up to SchemaVersion, it refuses databases from a newer version
+func migrate(conn *sql.DB) error {
+	_, err := conn.Exec(`CREATE TABLE IF NOT EXISTS schema_version (
+        "version" INTEGER NOT NULL PRIMARY KEY,
+        "name" TEXT,
+        "applied" DATETIME DEFAULT CURRENT_TIMESTAMP
+    );`)
+	if err != nil {
+		return err
+	}
+
+	var current int
+	if err := conn.QueryRow("SELECT COALESCE(MAX(version), 0) FROM schema_version").Scan(&current); err != nil {
+		return err
+	}
+	if current > SchemaVersion() {
+		return fmt.Errorf("%w: it is at version %d, this version of sote knows up to %d", ErrNewerSchema, current, SchemaVersion())
+	}
+
+	for _, m := range migrations {
+		if m.version <= current {
+			continue
+		}
+		if err := applyMigration(conn, m); err != nil {
+			return fmt.Errorf("migration %d (%s) failed: %v", m.version, m.name, err)
+		}
+		log.Printf("Database migrated to version %d: %s\n", m.version, m.name) // Debug print
+	}
+	return nil
+}
+
+// applyMigration runs a migration and records it, a failed migration leaves the database unchanged
+func applyMigration(conn *sql.DB, m migration) error {
+	tx, err := conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := m.up(tx); err != nil {
+		return err
+	}
+	_, err = tx.Exec("INSERT INTO schema_version (version, name) VALUES (?, ?)", m.version, m.name)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// execAll runs statements in order and stops at the first error
+func execAll(tx *sql.Tx, statements ...string) error {
+	for _, statement := range statements {
+		if _, err := tx.Exec(statement); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// createTables creates the tables that don't exist yet
+func createTables(tx *sql.Tx) error {
+	return execAll(tx,
+		`CREATE TABLE IF NOT EXISTS user (
+        "id" INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+        "username" TEXT UNIQUE,
+        "password" TEXT,
+        "privateKey" BLOB,
+        "publicKey" BLOB,
+        "onionAddress" TEXT,
+        "torrcFilePath" TEXT,
+        "onionPrivateKey" BLOB,
+        "socksPort" INTEGER NOT NULL DEFAULT 0,
+        "controlPort" INTEGER NOT NULL DEFAULT 0,
+        "servicePort" INTEGER NOT NULL DEFAULT 0,
+        "kdfParams" TEXT
+    );`,
+		`CREATE TABLE IF NOT EXISTS contacts (
+        "id" INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+        "userId" INTEGER REFERENCES user(id) ON DELETE CASCADE,
+        "username" TEXT,
+        "contactUsername" TEXT,
+        "contactOnionAddress" TEXT,
+        "contactPublicKey" BLOB,
+        "fingerprint" TEXT,
+        "nickname" TEXT,
+        "deliveryReceipts" INTEGER NOT NULL DEFAULT 1,
+        "readReceipts" INTEGER NOT NULL DEFAULT 1
+    );`,
+		`CREATE TABLE IF NOT EXISTS messages (
+        "id" INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+        "userId" INTEGER REFERENCES user(id) ON DELETE CASCADE,
+        "sender" TEXT,
+        "receiver" TEXT,
+        "message" BLOB,
+        "timestamp" DATETIME DEFAULT CURRENT_TIMESTAMP,
+        "verified" INTEGER NOT NULL DEFAULT 0,
+        "state" TEXT NOT NULL DEFAULT 'delivered',
+        "owner" TEXT,
+        "uuid" TEXT,
+        "sentAt" INTEGER,
+        "seq" INTEGER,
+        "deliveredAt" INTEGER,
+        "readAt" INTEGER,
+        "groupId" TEXT,
+        "contactId" INTEGER REFERENCES contacts(id) ON DELETE CASCADE
+    );`,
+		`CREATE TABLE IF NOT EXISTS bridges (
+        "id" INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+        "line" TEXT UNIQUE,
+        "added" DATETIME DEFAULT CURRENT_TIMESTAMP
+    );`,
+		`CREATE TABLE IF NOT EXISTS contact_requests (
+        "id" INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+        "username" TEXT,
+        "onionAddress" TEXT,
+        "direction" TEXT,
+        "status" TEXT NOT NULL DEFAULT 'pending',
+        "contactUsername" TEXT,
+        "contactPublicKey" BLOB,
+        "created" DATETIME DEFAULT CURRENT_TIMESTAMP,
+        UNIQUE("username", "onionAddress", "direction")
+    );`,
+		`CREATE TABLE IF NOT EXISTS outbox (
+        "id" INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+        "messageId" INTEGER NOT NULL REFERENCES messages(id) ON DELETE CASCADE,
+        "username" TEXT,
+        "onionAddress" TEXT,
+        "payload" BLOB,
+        "attempts" INTEGER NOT NULL DEFAULT 0,
+        "nextAttempt" INTEGER NOT NULL DEFAULT 0,
+        "lastError" TEXT,
+        "expires" INTEGER NOT NULL DEFAULT 0,
+        "created" DATETIME DEFAULT CURRENT_TIMESTAMP
+    );`,
+		`CREATE TABLE IF NOT EXISTS receipts (
+        "id" INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+        "username" TEXT,
+        "onionAddress" TEXT,
+        "payload" BLOB,
+        "attempts" INTEGER NOT NULL DEFAULT 0,
+        "nextAttempt" INTEGER NOT NULL DEFAULT 0,
+        "expires" INTEGER NOT NULL DEFAULT 0
+    );`,
+		// A group as one account knows it, membership and signature are the creator's latest signed member list
+		`CREATE TABLE IF NOT EXISTS chat_groups (
+        "id" INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+        "owner" TEXT,
+        "groupId" TEXT,
+        "name" TEXT,
+        "creatorOnionAddress" TEXT,
+        "creatorPublicKey" BLOB,
+        "version" INTEGER NOT NULL DEFAULT 0,
+        "membership" BLOB,
+        "signature" BLOB,
+        "created" DATETIME DEFAULT CURRENT_TIMESTAMP,
+        UNIQUE(owner, groupId)
+    );`,
+		`CREATE TABLE IF NOT EXISTS group_members (
+        "id" INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+        "owner" TEXT,
+        "groupId" TEXT,
+        "username" TEXT,
+        "onionAddress" TEXT,
+        "publicKey" BLOB,
+        UNIQUE(owner, groupId, onionAddress)
+    );`,
+		`CREATE TABLE IF NOT EXISTS group_updates (
+        "id" INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+        "username" TEXT,
+        "onionAddress" TEXT,
+        "payload" BLOB,
+        "attempts" INTEGER NOT NULL DEFAULT 0,
+        "nextAttempt" INTEGER NOT NULL DEFAULT 0,
+        "expires" INTEGER NOT NULL DEFAULT 0
+    );`,
+		`CREATE TABLE IF NOT EXISTS settings (
+        "key" TEXT NOT NULL PRIMARY KEY,
+        "value" TEXT
+    );`,
+	)
+}
+
+// addOlderColumns adds the columns that were added after their tables were first released
+func addOlderColumns(tx *sql.Tx) error {
+	newColumns := [][3]string{
+		{"user", "onionPrivateKey", "BLOB"},
+		{"user", "socksPort", "INTEGER NOT NULL DEFAULT 0"},
+		{"user", "controlPort", "INTEGER NOT NULL DEFAULT 0"},
+		{"user", "servicePort", "INTEGER NOT NULL DEFAULT 0"},
+		{"user", "kdfParams", "TEXT"},
+		{"messages", "verified", "INTEGER NOT NULL DEFAULT 0"},
+		{"messages", "state", "TEXT NOT NULL DEFAULT 'delivered'"},
+		{"messages", "owner", "TEXT"},
+		{"messages", "uuid", "TEXT"},
+		{"messages", "sentAt", "INTEGER"},
+		{"messages", "seq", "INTEGER"},
+		{"messages", "deliveredAt", "INTEGER"},
+		{"messages", "readAt", "INTEGER"},
+		{"messages", "groupId", "TEXT"},
+		{"messages", "userId", "INTEGER REFERENCES user(id) ON DELETE CASCADE"},
+		{"messages", "contactId", "INTEGER REFERENCES contacts(id) ON DELETE CASCADE"},
+		{"contacts", "userId", "INTEGER REFERENCES user(id) ON DELETE CASCADE"},
+		{"contacts", "fingerprint", "TEXT"},
+		{"contacts", "nickname", "TEXT"},
+		{"contacts", "deliveryReceipts", "INTEGER NOT NULL DEFAULT 1"},
+		{"contacts", "readReceipts", "INTEGER NOT NULL DEFAULT 1"},
+		{"contact_requests", "status", "TEXT NOT NULL DEFAULT 'pending'"},
+		{"contact_requests", "contactUsername", "TEXT"},
+		{"contact_requests", "contactPublicKey", "BLOB"},
+	}
+	for _, c := range newColumns {
+		if err := addColumnIfMissing(tx, c[0], c[1], c[2]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// setMessageOwners sets the owner of older messages. Received messages are armored PGP,
+// sent ones are the sender's own AES copy.
+func setMessageOwners(tx *sql.Tx) error {
+	return execAll(tx,
+		`UPDATE messages SET owner = CASE WHEN CAST(message AS TEXT) LIKE '-----BEGIN PGP MESSAGE%' THEN receiver ELSE sender END WHERE owner IS NULL`,
+		// A message is stored once per account, redelivered messages are ignored
+		`CREATE UNIQUE INDEX IF NOT EXISTS messages_owner_uuid ON messages (owner, uuid)`,
+	)
+}
+
+// referenceAccounts sets the account ID of contacts and messages from before they referenced their account by ID
+func referenceAccounts(tx *sql.Tx) error {
+	return execAll(tx,
+		`UPDATE contacts SET userId = (SELECT id FROM user WHERE user.username = contacts.username) WHERE userId IS NULL`,
+		`UPDATE messages SET userId = (SELECT id FROM user WHERE user.username = messages.owner) WHERE userId IS NULL`,
+		`CREATE INDEX IF NOT EXISTS contacts_user ON contacts (userId)`,
+		`CREATE INDEX IF NOT EXISTS messages_user ON messages (userId)`,
+	)
+}
+
+// identifyContacts gives contacts from before they were identified by key a fingerprint and nickname,
+// their username becomes their nickname. Messages get the contact of their conversation.
+func identifyContacts(tx *sql.Tx) error {
+	if err := backfillContactIdentities(tx); err != nil {
+		return err
+	}
+	return execAll(tx,
+		`UPDATE messages SET contactId = (SELECT c.id FROM contacts c WHERE c.userId = messages.userId
+        AND c.contactUsername = CASE WHEN messages.sender = messages.owner THEN messages.receiver ELSE messages.sender END ORDER BY c.id LIMIT 1)
+        WHERE contactId IS NULL AND groupId IS NULL`,
+		`CREATE UNIQUE INDEX IF NOT EXISTS contacts_nickname ON contacts (userId, nickname)`,
+		`CREATE INDEX IF NOT EXISTS contacts_onion ON contacts (userId, contactOnionAddress)`,
+		`CREATE INDEX IF NOT EXISTS messages_contact ON messages (contactId)`,
+	)
+}
+
+// backfillContactIdentities sets the fingerprint and nickname of contacts saved before they had them
+func backfillContactIdentities(tx *sql.Tx) error {
+	rows, err := tx.Query("SELECT c.id, c.userId, c.contactUsername, c.contactPublicKey, c.fingerprint, c.nickname, u.username FROM contacts c JOIN user u ON u.id = c.userId WHERE c.fingerprint IS NULL OR c.nickname IS NULL")
+	if err != nil {
+		return err
+	}
+	type legacyContact struct {
+		id, userID            int
+		username, ownUsername string
+		publicKey             []byte
+		fingerprint, nickname sql.NullString
+	}
+	var contacts []legacyContact
+	for rows.Next() {
+		var c legacyContact
+		var username sql.NullString
+		if err := rows.Scan(&c.id, &c.userID, &username, &c.publicKey, &c.fingerprint, &c.nickname, &c.ownUsername); err != nil {
+			rows.Close()
+			return err
+		}
+		c.username = username.String
+		contacts = append(contacts, c)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, c := range contacts {
+		fingerprint := c.fingerprint.String
+		if !c.fingerprint.Valid {
+			if fingerprint, err = user.Fingerprint(c.publicKey); err != nil {
+				log.Println("Contact has an unreadable public key:", c.id, err) // Debug print
+			}
+		}
+		nickname := c.nickname.String
+		if !c.nickname.Valid {
+			if nickname, err = uniqueNickname(tx, c.userID, c.ownUsername, c.username); err != nil {
+				return err
+			}
+		}
+		_, err = tx.Exec("UPDATE contacts SET fingerprint = ?, nickname = ? WHERE id = ?", fingerprint, nickname, c.id)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// indexMessages makes sequence numbers unique per conversation, two contacts may share a username
+func indexMessages(tx *sql.Tx) error {
+	return execAll(tx,
+		`DROP INDEX IF EXISTS messages_sent_seq`,
+		`CREATE UNIQUE INDEX IF NOT EXISTS messages_contact_seq ON messages (userId, contactId, seq) WHERE owner = sender AND groupId IS NULL`,
+		`CREATE UNIQUE INDEX IF NOT EXISTS messages_group_seq ON messages (userId, groupId, seq) WHERE owner = sender AND groupId IS NOT NULL`,
+	)
+}
+
+// addDataKeys adds the encrypted key of each account's own database
+func addDataKeys(tx *sql.Tx) error {
+	return addColumnIfMissing(tx, "user", "dataKey", "BLOB")
+}
+
+// scopeMessageIDs makes message IDs unique per conversation instead of per account.
+// Senders choose the IDs, one contact's ID must not hide another contact's message.
+func scopeMessageIDs(tx *sql.Tx) error {
+	return execAll(tx,
+		`DROP INDEX IF EXISTS messages_owner_uuid`,
+		`CREATE UNIQUE INDEX IF NOT EXISTS messages_contact_uuid ON messages (userId, contactId, uuid) WHERE groupId IS NULL`,
+		`CREATE UNIQUE INDEX IF NOT EXISTS messages_group_uuid ON messages (userId, groupId, uuid) WHERE groupId IS NOT NULL`,
+	)
+}
+
+// referenceAccountsEverywhere moves contact requests, queues and groups from the account's username to its ID,
+// like referenceAccounts did for contacts and messages
+func referenceAccountsEverywhere(tx *sql.Tx) error {
+	tables := [][2]string{
+		{"contact_requests", "username"},
+		{"outbox", "username"},
+		{"receipts", "username"},
+		{"chat_groups", "owner"},
+		{"group_members", "owner"},
+		{"group_updates", "username"},
+	}
+	for _, t := range tables {
+		if err := addColumnIfMissing(tx, t[0], "userId", "INTEGER REFERENCES user(id) ON DELETE CASCADE"); err != nil {
+			return err
+		}
+		_, err := tx.Exec(fmt.Sprintf("UPDATE %s SET userId = (SELECT id FROM user WHERE user.username = %s.%s) WHERE userId IS NULL", t[0], t[0], t[1]))
+		if err != nil {
+			return err
+		}
+	}
+	return execAll(tx,
+		`CREATE UNIQUE INDEX IF NOT EXISTS contact_requests_user ON contact_requests (userId, onionAddress, direction)`,
+		`CREATE INDEX IF NOT EXISTS outbox_user ON outbox (userId, nextAttempt)`,
+		`CREATE INDEX IF NOT EXISTS receipts_user ON receipts (userId, nextAttempt)`,
+		`CREATE UNIQUE INDEX IF NOT EXISTS chat_groups_user ON chat_groups (userId, groupId)`,
+		`CREATE UNIQUE INDEX IF NOT EXISTS group_members_user ON group_members (userId, groupId, onionAddress)`,
+		`CREATE INDEX IF NOT EXISTS group_updates_user ON group_updates (userId, nextAttempt)`,
+	)
+}
+
+// recordMessageDirection marks the messages an account sent. Comparing the sender with the account's
+// username mixes up contacts who chose the same name, the stored message tells instead: received
+// messages are armored PGP, sent ones are the account's own AES copy.
+func recordMessageDirection(tx *sql.Tx) error {
+	if err := addColumnIfMissing(tx, "messages", "outgoing", "INTEGER NOT NULL DEFAULT 0"); err != nil {
+		return err
+	}
+	return execAll(tx,
+		`UPDATE messages SET outgoing = CASE WHEN CAST(message AS TEXT) LIKE '-----BEGIN PGP MESSAGE%' THEN 0 ELSE 1 END`,
+		`DROP INDEX IF EXISTS messages_contact_seq`,
+		`DROP INDEX IF EXISTS messages_group_seq`,
+		`CREATE UNIQUE INDEX IF NOT EXISTS messages_contact_seq ON messages (userId, contactId, seq) WHERE outgoing = 1 AND groupId IS NULL`,
+		`CREATE UNIQUE INDEX IF NOT EXISTS messages_group_seq ON messages (userId, groupId, seq) WHERE outgoing = 1 AND groupId IS NOT NULL`,
+	)
+}
+
+// requeueRetriedMessages moves messages that are still in the outbox back to queued,
+// they used to become sent after the first failed attempt
+func requeueRetriedMessages(tx *sql.Tx) error {
+	_, err := tx.Exec(`UPDATE messages SET state = 'queued' WHERE state = 'sent' AND EXISTS (SELECT 1 FROM outbox WHERE outbox.messageId = messages.id)`)
+	return err
+}
+
+// addColumnIfMissing adds a column to an existing table of an older database
+func addColumnIfMissing(tx *sql.Tx, table, column, definition string) error {
+	rows, err := tx.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			cid        int
+			name       string
+			columnType string
+			notNull    int
+			dfltValue  sql.NullString
+			pk         int
+		)
+		if err := rows.Scan(&cid, &name, &columnType, &notNull, &dfltValue, &pk); err != nil {
+			return err
+		}
+		if name == column {
+			return nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	rows.Close()
+
+	_, err = tx.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition))
+	return err
+}
@@ -0,0 +1,359 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/ProtonMail/gopenpgp/v2/crypto"
+)
+
+// baselineSchema is the database of the first release, before anything was migrated
+const baselineSchema = `
+CREATE TABLE user (
+    "id" INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+    "username" TEXT UNIQUE,
+    "password" TEXT,
+    "privateKey" BLOB,
+    "publicKey" BLOB,
+    "onionAddress" TEXT,
+    "torrcFilePath" TEXT
+);
+CREATE TABLE contacts (
+    "id" INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+    "username" TEXT,
+    "contactUsername" TEXT,
+    "contactOnionAddress" TEXT,
+    "contactPublicKey" BLOB
+);
+CREATE TABLE messages (
+    "id" INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+    "sender" TEXT,
+    "receiver" TEXT,
+    "message" BLOB,
+    "timestamp" DATETIME DEFAULT CURRENT_TIMESTAMP
+);`
+
+// legacySchema is a database from before schema_version, when sent sequence numbers were
+// indexed by messages_sent_seq and everything referenced the account by username
+const legacySchema = baselineSchema + `
+ALTER TABLE user ADD COLUMN "onionPrivateKey" BLOB;
+ALTER TABLE user ADD COLUMN "kdfParams" TEXT;
+ALTER TABLE messages ADD COLUMN "verified" INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE messages ADD COLUMN "state" TEXT NOT NULL DEFAULT 'delivered';
+ALTER TABLE messages ADD COLUMN "owner" TEXT;
+ALTER TABLE messages ADD COLUMN "uuid" TEXT;
+ALTER TABLE messages ADD COLUMN "sentAt" INTEGER;
+ALTER TABLE messages ADD COLUMN "seq" INTEGER;
+CREATE UNIQUE INDEX messages_owner_uuid ON messages (owner, uuid);
+CREATE UNIQUE INDEX messages_sent_seq ON messages (owner, receiver, seq) WHERE owner = sender;
+CREATE TABLE contact_requests (
+    "id" INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+    "username" TEXT,
+    "onionAddress" TEXT,
+    "direction" TEXT,
+    "status" TEXT NOT NULL DEFAULT 'pending',
+    "created" DATETIME DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE("username", "onionAddress", "direction")
+);
+CREATE TABLE outbox (
+    "id" INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+    "messageId" INTEGER NOT NULL REFERENCES messages(id) ON DELETE CASCADE,
+    "username" TEXT,
+    "onionAddress" TEXT,
+    "payload" BLOB,
+    "attempts" INTEGER NOT NULL DEFAULT 0,
+    "nextAttempt" INTEGER NOT NULL DEFAULT 0,
+    "lastError" TEXT,
+    "expires" INTEGER NOT NULL DEFAULT 0,
+    "created" DATETIME DEFAULT CURRENT_TIMESTAMP
+);`
+
+// receivedPayload stands for a received message, those are stored as armored PGP
+const receivedPayload = "-----BEGIN PGP MESSAGE-----\n\nwcBMA\n-----END PGP MESSAGE-----"
+
+// wantColumns are columns that only migrations add to older tables
+var wantColumns = map[string][]string{
+	"user":             {"onionPrivateKey", "socksPort", "controlPort", "servicePort", "kdfParams", "dataKey"},
+	"contacts":         {"userId", "fingerprint", "nickname", "deliveryReceipts", "readReceipts"},
+	"messages":         {"userId", "contactId", "owner", "uuid", "sentAt", "seq", "deliveredAt", "readAt", "groupId", "outgoing"},
+	"contact_requests": {"userId", "contactUsername", "contactPublicKey"},
+	"outbox":           {"userId"},
+	"receipts":         {"userId"},
+	"chat_groups":      {"userId"},
+	"group_members":    {"userId"},
+	"group_updates":    {"userId"},
+}
+
+// wantIndexes are the indexes of a database at SchemaVersion
+var wantIndexes = []string{
+	"contacts_user", "messages_user", "contacts_nickname", "contacts_onion", "messages_contact",
+	"messages_contact_seq", "messages_group_seq", "messages_contact_uuid", "messages_group_uuid",
+	"contact_requests_user", "outbox_user", "receipts_user", "chat_groups_user", "group_members_user", "group_updates_user",
+}
+
+// droppedIndexes were replaced by later migrations
+var droppedIndexes = []string{"messages_sent_seq", "messages_owner_uuid"}
+
+// fixture opens an in-memory database and creates schema in it
+func fixture(t *testing.T, schema string) *sql.DB {
+	t.Helper()
+	conn, err := openMemoryDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	if schema != "" {
+		if _, err := conn.Exec(schema); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return conn
+}
+
+// testPublicKey returns an armored public key and its fingerprint
+func testPublicKey(t *testing.T, name string) (string, string) {
+	t.Helper()
+	key, err := crypto.GenerateKey(name, "", "x25519", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	publicKey, err := key.GetArmoredPublicKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return publicKey, key.GetFingerprint()
+}
+
+func mustExec(t *testing.T, conn *sql.DB, query string, args ...interface{}) {
+	t.Helper()
+	if _, err := conn.Exec(query, args...); err != nil {
+		t.Fatalf("%s: %v", query, err)
+	}
+}
+
+// checkSchema asserts that a migrated database is at SchemaVersion with every column and index
+func checkSchema(t *testing.T, conn *sql.DB) {
+	t.Helper()
+	var version int
+	if err := conn.QueryRow("SELECT MAX(version) FROM schema_version").Scan(&version); err != nil {
+		t.Fatal(err)
+	}
+	if version != SchemaVersion() {
+		t.Errorf("schema version is %d, want %d", version, SchemaVersion())
+	}
+
+	for table, columns := range wantColumns {
+		rows, err := conn.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
+		if err != nil {
+			t.Fatal(err)
+		}
+		have := map[string]bool{}
+		for rows.Next() {
+			var (
+				cid        int
+				name       string
+				columnType string
+				notNull    int
+				dfltValue  sql.NullString
+				pk         int
+			)
+			if err := rows.Scan(&cid, &name, &columnType, &notNull, &dfltValue, &pk); err != nil {
+				t.Fatal(err)
+			}
+			have[name] = true
+		}
+		rows.Close()
+		for _, column := range columns {
+			if !have[column] {
+				t.Errorf("%s has no column %s", table, column)
+			}
+		}
+	}
+
+	for _, index := range wantIndexes {
+		if !hasIndex(t, conn, index) {
+			t.Errorf("index %s is missing", index)
+		}
+	}
+	for _, index := range droppedIndexes {
+		if hasIndex(t, conn, index) {
+			t.Errorf("index %s was not dropped", index)
+		}
+	}
+}
+
+func hasIndex(t *testing.T, conn *sql.DB, name string) bool {
+	t.Helper()
+	var exists bool
+	err := conn.QueryRow("SELECT EXISTS (SELECT 1 FROM sqlite_master WHERE type = 'index' AND name = ?)", name).Scan(&exists)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return exists
+}
+
+func TestMigrateBaseline(t *testing.T) {
+	conn := fixture(t, baselineSchema)
+	bobKey, bobFingerprint := testPublicKey(t, "bob")
+	aliceKey, aliceFingerprint := testPublicKey(t, "alice")
+	mustExec(t, conn, "INSERT INTO user (username, onionAddress) VALUES ('alice', 'alice.onion')")
+	mustExec(t, conn, "INSERT INTO contacts (username, contactUsername, contactOnionAddress, contactPublicKey) VALUES ('alice', 'bob', 'bob.onion', ?)", bobKey)
+	// A contact who chose the owner's own username
+	mustExec(t, conn, "INSERT INTO contacts (username, contactUsername, contactOnionAddress, contactPublicKey) VALUES ('alice', 'alice', 'other.onion', ?)", aliceKey)
+	mustExec(t, conn, "INSERT INTO messages (sender, receiver, message) VALUES ('bob', 'alice', ?)", receivedPayload)
+	mustExec(t, conn, "INSERT INTO messages (sender, receiver, message) VALUES ('alice', 'bob', ?)", []byte{0x8f, 0x01, 0x02})
+
+	if err := migrate(conn); err != nil {
+		t.Fatal(err)
+	}
+	checkSchema(t, conn)
+
+	contacts := map[string]struct {
+		fingerprint, nickname string
+	}{
+		"bob.onion":   {bobFingerprint, "bob"},
+		"other.onion": {aliceFingerprint, "alice-2"},
+	}
+	for onion, want := range contacts {
+		var userID int
+		var fingerprint, nickname string
+		err := conn.QueryRow("SELECT userId, fingerprint, nickname FROM contacts WHERE contactOnionAddress = ?", onion).Scan(&userID, &fingerprint, &nickname)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if userID != 1 || fingerprint != want.fingerprint || nickname != want.nickname {
+			t.Errorf("contact %s has userId %d, fingerprint %s, nickname %s, want 1, %s, %s", onion, userID, fingerprint, nickname, want.fingerprint, want.nickname)
+		}
+	}
+
+	var bobID int
+	if err := conn.QueryRow("SELECT id FROM contacts WHERE contactOnionAddress = 'bob.onion'").Scan(&bobID); err != nil {
+		t.Fatal(err)
+	}
+	rows, err := conn.Query("SELECT sender, userId, contactId, owner, outgoing FROM messages ORDER BY id")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	wantOutgoing := map[string]bool{"bob": false, "alice": true}
+	for rows.Next() {
+		var sender, owner string
+		var userID, contactID int
+		var outgoing bool
+		if err := rows.Scan(&sender, &userID, &contactID, &owner, &outgoing); err != nil {
+			t.Fatal(err)
+		}
+		if userID != 1 || contactID != bobID || owner != "alice" || outgoing != wantOutgoing[sender] {
+			t.Errorf("message from %s has userId %d, contactId %d, owner %s, outgoing %v", sender, userID, contactID, owner, outgoing)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMigrateLegacy(t *testing.T) {
+	conn := fixture(t, legacySchema)
+	bobKey, bobFingerprint := testPublicKey(t, "bob")
+	mustExec(t, conn, "INSERT INTO user (username, onionAddress) VALUES ('carol', 'carol.onion'), ('alice', 'alice.onion')")
+	mustExec(t, conn, "INSERT INTO contacts (username, contactUsername, contactOnionAddress, contactPublicKey) VALUES ('alice', 'bob', 'bob.onion', ?)", bobKey)
+	// Both sides' first messages have seq 1, received ones aren't in messages_sent_seq
+	mustExec(t, conn, "INSERT INTO messages (sender, receiver, message, owner, uuid, seq) VALUES ('alice', 'bob', ?, 'alice', 'u1', 1)", []byte{0x8f})
+	mustExec(t, conn, "INSERT INTO messages (sender, receiver, message, owner, uuid, seq) VALUES ('bob', 'alice', ?, 'alice', 'u2', 1)", receivedPayload)
+	mustExec(t, conn, "INSERT INTO contact_requests (username, onionAddress, direction) VALUES ('alice', 'dave.onion', 'incoming')")
+	mustExec(t, conn, "INSERT INTO outbox (messageId, username, onionAddress) VALUES (1, 'alice', 'bob.onion')")
+
+	if err := migrate(conn); err != nil {
+		t.Fatal(err)
+	}
+	checkSchema(t, conn)
+
+	var userID int
+	var fingerprint, nickname string
+	err := conn.QueryRow("SELECT userId, fingerprint, nickname FROM contacts").Scan(&userID, &fingerprint, &nickname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if userID != 2 || fingerprint != bobFingerprint || nickname != "bob" {
+		t.Errorf("contact has userId %d, fingerprint %s, nickname %s", userID, fingerprint, nickname)
+	}
+
+	var sent, received int
+	err = conn.QueryRow("SELECT COUNT(*) FILTER (WHERE outgoing = 1), COUNT(*) FILTER (WHERE outgoing = 0) FROM messages WHERE userId = 2 AND contactId = 1 AND seq = 1").Scan(&sent, &received)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sent != 1 || received != 1 {
+		t.Errorf("conversation has %d sent and %d received messages with seq 1, want 1 and 1", sent, received)
+	}
+
+	for _, table := range []string{"contact_requests", "outbox"} {
+		if err := conn.QueryRow("SELECT userId FROM " + table).Scan(&userID); err != nil {
+			t.Fatal(err)
+		}
+		if userID != 2 {
+			t.Errorf("%s row has userId %d, want 2", table, userID)
+		}
+	}
+
+	// The same message ID from another conversation is a different message
+	mustExec(t, conn, "INSERT INTO contacts (userId, contactUsername, fingerprint, nickname) VALUES (2, 'eve', 'EVE', 'eve')")
+	mustExec(t, conn, "INSERT INTO messages (userId, contactId, sender, uuid) VALUES (2, 2, 'eve', 'u2')")
+	if _, err := conn.Exec("INSERT INTO messages (userId, contactId, sender, uuid) VALUES (2, 1, 'bob', 'u2')"); err == nil {
+		t.Error("a redelivered message ID was stored twice in one conversation")
+	}
+}
+
+// Databases at every version migrate to the same schema and get their rows' account IDs
+func TestMigrateFromEachVersion(t *testing.T) {
+	for n := 1; n < SchemaVersion(); n++ {
+		t.Run(fmt.Sprintf("version %d", n), func(t *testing.T) {
+			conn := fixture(t, `CREATE TABLE schema_version (
+                "version" INTEGER NOT NULL PRIMARY KEY,
+                "name" TEXT,
+                "applied" DATETIME DEFAULT CURRENT_TIMESTAMP
+            );`)
+			for _, m := range migrations[:n] {
+				if err := applyMigration(conn, m); err != nil {
+					t.Fatal(err)
+				}
+			}
+			mustExec(t, conn, "INSERT INTO user (username) VALUES ('alice')")
+			mustExec(t, conn, "INSERT INTO contact_requests (username, onionAddress, direction) VALUES ('alice', 'bob.onion', 'outgoing')")
+			mustExec(t, conn, "INSERT INTO group_members (owner, groupId, onionAddress) VALUES ('alice', 'g1', 'bob.onion')")
+
+			if err := migrate(conn); err != nil {
+				t.Fatal(err)
+			}
+			checkSchema(t, conn)
+			for _, table := range []string{"contact_requests", "group_members"} {
+				var userID sql.NullInt64
+				if err := conn.QueryRow("SELECT userId FROM " + table).Scan(&userID); err != nil {
+					t.Fatal(err)
+				}
+				// Rows saved after migration 9 have their userId set by the store
+				if n < 9 && userID.Int64 != 1 {
+					t.Errorf("%s row has userId %v, want 1", table, userID)
+				}
+			}
+		})
+	}
+}
+
+func TestMigrateNewerSchema(t *testing.T) {
+	conn := fixture(t, "")
+	if err := migrate(conn); err != nil {
+		t.Fatal(err)
+	}
+	// Migrating again changes nothing
+	if err := migrate(conn); err != nil {
+		t.Fatal(err)
+	}
+
+	mustExec(t, conn, "INSERT INTO schema_version (version, name) VALUES (?, 'from the future')", SchemaVersion()+1)
+	if err := migrate(conn); !errors.Is(err, ErrNewerSchema) {
+		t.Errorf("migrating a newer database returned %v, want ErrNewerSchema", err)
+	}
+}
@@ -0,0 +1,174 @@
+package db
+
+import (
+	"database/sql"
+	"sote/user"
+	"time"
+)
+
+// Delivery states of a sent message
+const (
+	// MessageQueued is in the outbox, it is retried until the peer accepts it
+	MessageQueued = "queued"
+	// MessageSent was accepted by the peer's node. Group messages have no receipts and stay sent.
+	MessageSent = "sent"
+	// MessageDelivered was confirmed by the receiver's delivery or read receipt
+	MessageDelivered = "delivered"
+	// MessageFailed was refused by the peer or could not be delivered in time
+	MessageFailed = "failed"
+)
+
+// OutboxEntry struct to hold a message waiting for delivery
+type OutboxEntry struct {
+	ID           int
+	MessageID    int
+	OnionAddress string
+	// Payload is the message encrypted to the receiver
+	Payload  []byte
+	Attempts int
+	Expires  time.Time
+
+	// Fields of the queued message
+	Sender   string
+	Receiver string
+	UUID     string
+	SentAt   int64
+	Seq      int
+	// GroupID is set when the message was sent to a group, each member has an entry
+	GroupID string
+	// Contact is the nickname of the contact a direct message was sent to
+	Contact string
+
+	// userID is the account the entry belongs to
+	userID int
+}
+
+// QueueMessage saves a sent message and its outbox entry in one transaction and returns the message's sequence number.
+// message is the sender's own copy, payload is the message encrypted to the receiver.
+// The message fails if it isn't delivered before expires.
+func (s *SQLiteStore) QueueMessage(userID int, contact user.Contact, sender string, message, payload []byte, uuid string, sentAt time.Time, expires time.Time) (int, error) {
+	return s.queueMessage(userID, contact.ID, sender, contact.Fingerprint, "", []string{contact.OnionAddress}, message, payload, uuid, sentAt, expires)
+}
+
+// QueueGroupMessage saves a message sent to a group with an outbox entry for every other member.
+// payload is the message encrypted to all of them at once.
+func (s *SQLiteStore) QueueGroupMessage(userID int, sender, groupID string, onionAddresses []string, message, payload []byte, uuid string, sentAt time.Time, expires time.Time) (int, error) {
+	return s.queueMessage(userID, 0, sender, groupID, groupID, onionAddresses, message, payload, uuid, sentAt, expires)
+}
+
+func (s *SQLiteStore) queueMessage(userID, contactID int, sender, receiver, groupID string, onionAddresses []string, message, payload []byte, uuid string, sentAt time.Time, expires time.Time) (int, error) {
+	conn, err := s.accountDB(userID)
+	if err != nil {
+		return 0, err
+	}
+	tx, err := conn.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	// Sequence numbers count the sender's messages in the conversation
+	var seq int
+	if groupID != "" {
+		err = tx.QueryRow("SELECT COALESCE(MAX(seq), 0) + 1 FROM messages WHERE userId = ? AND outgoing = 1 AND groupId = ?", userID, groupID).Scan(&seq)
+	} else {
+		err = tx.QueryRow("SELECT COALESCE(MAX(seq), 0) + 1 FROM messages WHERE userId = ? AND outgoing = 1 AND contactId = ? AND groupId IS NULL", userID, contactID).Scan(&seq)
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	// A group message with nobody else to deliver it to is done right away
+	state := MessageQueued
+	if len(onionAddresses) == 0 {
+		state = MessageSent
+	}
+	contact := sql.NullInt64{Int64: int64(contactID), Valid: contactID != 0}
+	result, err := tx.Exec("INSERT INTO messages (userId, contactId, sender, receiver, message, timestamp, verified, state, owner, uuid, sentAt, seq, groupId, outgoing) VALUES (?, ?, ?, ?, ?, CURRENT_TIMESTAMP, 1, ?, ?, ?, ?, ?, ?, 1)", userID, contact, sender, receiver, message, state, sender, uuid, sentAt.Unix(), seq, nullString(groupID))
+	if err != nil {
+		return 0, err
+	}
+	messageID, err := result.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+	for _, onionAddress := range onionAddresses {
+		_, err = tx.Exec("INSERT INTO outbox (messageId, userId, onionAddress, payload, expires) VALUES (?, ?, ?, ?, ?)", messageID, userID, onionAddress, payload, expires.Unix())
+		if err != nil {
+			return 0, err
+		}
+	}
+	return seq, tx.Commit()
+}
+
+// GetDueOutbox retrieves the outbox entries of a user whose next attempt is due
+func (s *SQLiteStore) GetDueOutbox(userID int, now time.Time) ([]OutboxEntry, error) {
+	conn, err := s.accountDB(userID)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := conn.Query(`SELECT o.id, o.messageId, o.onionAddress, o.payload, o.attempts, o.expires, m.sender, m.receiver, m.uuid, m.sentAt, m.seq, m.groupId, c.nickname
+        FROM outbox o JOIN messages m ON m.id = o.messageId LEFT JOIN contacts c ON c.id = m.contactId
+        WHERE o.userId = ? AND o.nextAttempt <= ? ORDER BY o.id`, userID, now.Unix())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var entries []OutboxEntry
+	for rows.Next() {
+		entry := OutboxEntry{userID: userID}
+		var expires int64
+		var uuid, groupID, contact sql.NullString
+		var sentAt, seq sql.NullInt64
+		err := rows.Scan(&entry.ID, &entry.MessageID, &entry.OnionAddress, &entry.Payload, &entry.Attempts, &expires, &entry.Sender, &entry.Receiver, &uuid, &sentAt, &seq, &groupID, &contact)
+		if err != nil {
+			return nil, err
+		}
+		entry.Expires = time.Unix(expires, 0)
+		entry.UUID = uuid.String
+		entry.SentAt = sentAt.Int64
+		entry.Seq = int(seq.Int64)
+		entry.GroupID = groupID.String
+		entry.Contact = contact.String
+		entries = append(entries, entry)
+	}
+	return entries, rows.Err()
+}
+
+// RetryOutbox records a failed delivery attempt and when to try again, the message stays queued
+func (s *SQLiteStore) RetryOutbox(entry OutboxEntry, nextAttempt time.Time, lastError string) error {
+	conn, err := s.accountDB(entry.userID)
+	if err != nil {
+		return err
+	}
+	_, err = conn.Exec("UPDATE outbox SET attempts = attempts + 1, nextAttempt = ?, lastError = ? WHERE id = ?", nextAttempt.Unix(), lastError, entry.ID)
+	return err
+}
+
+// FinishOutbox removes an entry from the outbox and stores the state of its message.
+// A group message is sent once every member accepted it and failed if one member didn't get it.
+// A receipt that arrived before the peer's answer was handled keeps the message delivered.
+func (s *SQLiteStore) FinishOutbox(entry OutboxEntry, state string) error {
+	conn, err := s.accountDB(entry.userID)
+	if err != nil {
+		return err
+	}
+	tx, err := conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec("DELETE FROM outbox WHERE id = ?", entry.ID)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`UPDATE messages SET state = ? WHERE id = ?
+        AND (? = ? OR (state NOT IN (?, ?) AND NOT EXISTS (SELECT 1 FROM outbox WHERE messageId = ?)))`,
+		state, entry.MessageID, state, MessageFailed, MessageFailed, MessageDelivered, entry.MessageID)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,164 @@
+package db
+
+import (
+	"strings"
+	"time"
+)
+
+// Kinds of receipts a receiver sends back for messages
+const (
+	DeliveredReceipt = "delivered"
+	ReadReceipt      = "read"
+)
+
+// QueuedReceipt struct to hold a receipt waiting for delivery
+type QueuedReceipt struct {
+	ID           int
+	OnionAddress string
+	// Payload is the receipt encrypted to the contact and signed
+	Payload  []byte
+	Attempts int
+	Expires  time.Time
+
+	// userID is the account the receipt belongs to
+	userID int
+}
+
+// GetReceiptSettings reports which receipts an account sends to a contact
+func (s *SQLiteStore) GetReceiptSettings(userID, contactID int) (bool, bool, error) {
+	conn, err := s.accountDB(userID)
+	if err != nil {
+		return false, false, err
+	}
+	var delivered, read bool
+	err = conn.QueryRow("SELECT deliveryReceipts, readReceipts FROM contacts WHERE userId = ? AND id = ?", userID, contactID).Scan(&delivered, &read)
+	return delivered, read, notFound(err)
+}
+
+// SetReceiptSettings sets which receipts an account sends to a contact
+func (s *SQLiteStore) SetReceiptSettings(userID, contactID int, delivered, read bool) error {
+	conn, err := s.accountDB(userID)
+	if err != nil {
+		return err
+	}
+	_, err = conn.Exec("UPDATE contacts SET deliveryReceipts = ?, readReceipts = ? WHERE userId = ? AND id = ?", delivered, read, userID, contactID)
+	return err
+}
+
+// MarkMessagesRead sets readAt on an account's unread messages from a contact and returns their IDs
+func (s *SQLiteStore) MarkMessagesRead(userID, contactID int, readAt time.Time) ([]string, error) {
+	conn, err := s.accountDB(userID)
+	if err != nil {
+		return nil, err
+	}
+	tx, err := conn.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query("SELECT uuid FROM messages WHERE userId = ? AND contactId = ? AND groupId IS NULL AND outgoing = 0 AND readAt IS NULL AND uuid IS NOT NULL", userID, contactID)
+	if err != nil {
+		return nil, err
+	}
+	var uuids []string
+	for rows.Next() {
+		var uuid string
+		if err := rows.Scan(&uuid); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		uuids = append(uuids, uuid)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	_, err = tx.Exec("UPDATE messages SET readAt = ? WHERE userId = ? AND contactId = ? AND groupId IS NULL AND outgoing = 0 AND readAt IS NULL", readAt.Unix(), userID, contactID)
+	if err != nil {
+		return nil, err
+	}
+	return uuids, tx.Commit()
+}
+
+// RecordReceipt stores a contact's receipt on the messages the user sent them.
+// Either receipt makes the message delivered, times that are already set are kept.
+func (s *SQLiteStore) RecordReceipt(userID, contactID int, kind string, uuids []string, at time.Time) error {
+	conn, err := s.accountDB(userID)
+	if err != nil {
+		return err
+	}
+	if len(uuids) == 0 {
+		return nil
+	}
+	set := "state = ?, deliveredAt = COALESCE(deliveredAt, ?)"
+	args := []interface{}{MessageDelivered, at.Unix()}
+	if kind == ReadReceipt {
+		set += ", readAt = COALESCE(readAt, ?)"
+		args = append(args, at.Unix())
+	}
+	args = append(args, userID, contactID)
+	for _, uuid := range uuids {
+		args = append(args, uuid)
+	}
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(uuids)), ", ")
+	_, err = conn.Exec("UPDATE messages SET "+set+" WHERE userId = ? AND contactId = ? AND groupId IS NULL AND outgoing = 1 AND uuid IN ("+placeholders+")", args...)
+	return err
+}
+
+// QueueReceipt saves a receipt for delivery to a contact
+func (s *SQLiteStore) QueueReceipt(userID int, onionAddress string, payload []byte, expires time.Time) error {
+	conn, err := s.accountDB(userID)
+	if err != nil {
+		return err
+	}
+	_, err = conn.Exec("INSERT INTO receipts (userId, onionAddress, payload, expires) VALUES (?, ?, ?, ?)", userID, onionAddress, payload, expires.Unix())
+	return err
+}
+
+// GetDueReceipts retrieves the queued receipts of a user whose next attempt is due
+func (s *SQLiteStore) GetDueReceipts(userID int, now time.Time) ([]QueuedReceipt, error) {
+	conn, err := s.accountDB(userID)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := conn.Query("SELECT id, onionAddress, payload, attempts, expires FROM receipts WHERE userId = ? AND nextAttempt <= ? ORDER BY id", userID, now.Unix())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var receipts []QueuedReceipt
+	for rows.Next() {
+		receipt := QueuedReceipt{userID: userID}
+		var expires int64
+		err := rows.Scan(&receipt.ID, &receipt.OnionAddress, &receipt.Payload, &receipt.Attempts, &expires)
+		if err != nil {
+			return nil, err
+		}
+		receipt.Expires = time.Unix(expires, 0)
+		receipts = append(receipts, receipt)
+	}
+	return receipts, rows.Err()
+}
+
+// RetryReceipt records a failed delivery attempt of a receipt and when to try again
+func (s *SQLiteStore) RetryReceipt(receipt QueuedReceipt, nextAttempt time.Time) error {
+	conn, err := s.accountDB(receipt.userID)
+	if err != nil {
+		return err
+	}
+	_, err = conn.Exec("UPDATE receipts SET attempts = attempts + 1, nextAttempt = ? WHERE id = ?", nextAttempt.Unix(), receipt.ID)
+	return err
+}
+
+// DeleteReceipt removes a receipt that was delivered or given up on
+func (s *SQLiteStore) DeleteReceipt(receipt QueuedReceipt) error {
+	conn, err := s.accountDB(receipt.userID)
+	if err != nil {
+		return err
+	}
+	_, err = conn.Exec("DELETE FROM receipts WHERE id = ?", receipt.ID)
+	return err
+}
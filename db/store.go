@@ -0,0 +1,125 @@
+package db
+
+import (
+	"errors"
+	"sote/user"
+	"time"
+)
+
+// ErrNotFound is returned by the lookups of a Store when there is no such user, contact, request, group or member
+var ErrNotFound = errors.New("not found")
+
+// Store is where the node and the client keep their data.
+// SQLiteStore implements it with files, NewMemoryStore keeps it in memory.
+type Store interface {
+	Users
+	Contacts
+	ContactRequests
+	Messages
+	Outbox
+	Receipts
+	Groups
+	Bridges
+	Settings
+	Close() error
+}
+
+// Users are the accounts in the main database. An account's own data is only
+// readable between OpenAccount and CloseAccount.
+type Users interface {
+	SaveUser(u UserRow) (int, error)
+	GetUser(username string) (UserRow, error)
+	GetKDFParams(username string) (string, error)
+	GetOnionPrivateKey(username string) ([]byte, error)
+	UpdateOnionPrivateKey(username string, onionPrivateKey []byte, torrcFilePath string) error
+	GetTorPorts(username string) (int, int, int, error)
+	UpdateTorPorts(username string, socksPort, controlPort, servicePort int) error
+	GetDataKey(username string) ([]byte, error)
+	SetDataKey(username string, dataKey []byte) error
+	OpenAccount(userID int, dataKey []byte) error
+	CloseAccount(userID int) error
+}
+
+// LegacyMigrator moves accounts from before Argon2id to their new keys. It isn't part of Store,
+// only stores that can hold such accounts implement it.
+type LegacyMigrator interface {
+	GetSentMessages(userID int) ([]Message, error)
+	UpdateUserKeys(username, password, kdfParams string, privateKey, onionPrivateKey []byte, sentMessages []Message) error
+}
+
+// Contacts are an account's contacts
+type Contacts interface {
+	SaveContact(userID int, contactUsername, contactOnionAddress string, contactPublicKey []byte) (user.Contact, error)
+	RenameContact(userID, contactID int, nickname string) error
+	GetContacts(userID int) ([]user.Contact, error)
+	GetContact(userID int, nicknameOrFingerprint string) (user.Contact, error)
+	GetContactByOnionAddress(userID int, onionAddress string) (user.Contact, error)
+}
+
+// ContactRequests are the contact requests an account sent and received
+type ContactRequests interface {
+	SaveContactRequest(userID int, onionAddress, direction, contactUsername string, contactPublicKey []byte) error
+	GetContactRequests(userID int, direction, status string) ([]ContactRequest, error)
+	GetContactRequest(userID, id int) (ContactRequest, error)
+	SetContactRequestStatus(userID, id int, status string) error
+	HasContactRequest(userID int, onionAddress, direction string) (bool, error)
+	DeleteContactRequest(userID int, onionAddress, direction string) error
+}
+
+// Messages are the conversations with contacts and their receipts
+type Messages interface {
+	GetMessages(userID, contactID int) ([]Message, error)
+	SaveMessage(userID, contactID int, sender, receiver string, message []byte, verified bool, uuid string, sentAt int64, seq int) (bool, error)
+	GetReceiptSettings(userID, contactID int) (bool, bool, error)
+	SetReceiptSettings(userID, contactID int, delivered, read bool) error
+	MarkMessagesRead(userID, contactID int, readAt time.Time) ([]string, error)
+	RecordReceipt(userID, contactID int, kind string, uuids []string, at time.Time) error
+}
+
+// Outbox holds sent messages until they are delivered
+type Outbox interface {
+	QueueMessage(userID int, contact user.Contact, sender string, message, payload []byte, uuid string, sentAt time.Time, expires time.Time) (int, error)
+	QueueGroupMessage(userID int, sender, groupID string, onionAddresses []string, message, payload []byte, uuid string, sentAt time.Time, expires time.Time) (int, error)
+	GetDueOutbox(userID int, now time.Time) ([]OutboxEntry, error)
+	RetryOutbox(entry OutboxEntry, nextAttempt time.Time, lastError string) error
+	FinishOutbox(entry OutboxEntry, state string) error
+}
+
+// Receipts holds receipts until they are delivered
+type Receipts interface {
+	QueueReceipt(userID int, onionAddress string, payload []byte, expires time.Time) error
+	GetDueReceipts(userID int, now time.Time) ([]QueuedReceipt, error)
+	RetryReceipt(receipt QueuedReceipt, nextAttempt time.Time) error
+	DeleteReceipt(receipt QueuedReceipt) error
+}
+
+// Groups are an account's groups, their messages and the member list updates waiting to be delivered
+type Groups interface {
+	SaveGroup(userID int, group Group, membership, signature []byte) error
+	GetGroup(userID int, groupID string) (Group, error)
+	GetGroups(userID int) ([]Group, error)
+	GetGroupMember(userID int, groupID, onionAddress string) (GroupMember, error)
+	DeleteGroup(userID int, groupID string) error
+	GetGroupMessages(userID int, groupID string) ([]Message, error)
+	SaveGroupMessage(userID int, owner, sender, groupID string, message []byte, uuid string, sentAt int64, seq int) (bool, error)
+	QueueGroupUpdate(userID int, onionAddress string, payload []byte, expires time.Time) error
+	GetDueGroupUpdates(userID int, now time.Time) ([]QueuedGroupUpdate, error)
+	RetryGroupUpdate(update QueuedGroupUpdate, nextAttempt time.Time) error
+	DeleteGroupUpdate(update QueuedGroupUpdate) error
+}
+
+// Bridges are the tor bridges every account uses
+type Bridges interface {
+	SaveBridge(line string) error
+	GetBridges() ([]Bridge, error)
+	DeleteBridge(id int) error
+}
+
+// Settings are the node's settings
+type Settings interface {
+	GetSetting(key string) (string, error)
+	SetSetting(key, value string) error
+}
+
+var _ Store = (*SQLiteStore)(nil)
+var _ LegacyMigrator = (*SQLiteStore)(nil)
@@ -0,0 +1,109 @@
+package db
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// Lookups report missing rows with ErrNotFound, callers don't depend on database/sql
+func TestLookupsReturnErrNotFound(t *testing.T) {
+	store, err := NewMemoryStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	if _, err := store.GetUser("nobody"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("GetUser returned %v", err)
+	}
+	if _, _, _, err := store.GetTorPorts("nobody"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("GetTorPorts returned %v", err)
+	}
+	userID, err := store.SaveUser(UserRow{Username: "alice", OnionAddress: "alice.onion"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.OpenAccount(userID, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := store.GetContact(userID, "bob"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("GetContact returned %v", err)
+	}
+	if _, err := store.GetContactByOnionAddress(userID, "bob.onion"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("GetContactByOnionAddress returned %v", err)
+	}
+	if _, err := store.GetContactRequest(userID, 1); !errors.Is(err, ErrNotFound) {
+		t.Errorf("GetContactRequest returned %v", err)
+	}
+	if _, _, err := store.GetReceiptSettings(userID, 1); !errors.Is(err, ErrNotFound) {
+		t.Errorf("GetReceiptSettings returned %v", err)
+	}
+	if _, err := store.GetGroup(userID, "g1"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("GetGroup returned %v", err)
+	}
+	if _, err := store.GetGroupMember(userID, "g1", "bob.onion"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("GetGroupMember returned %v", err)
+	}
+}
+
+// A message stays queued while it is retried, becomes sent once the peer accepts it
+// and delivered when the receipt comes back
+func TestOutboxStates(t *testing.T) {
+	store, err := NewMemoryStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	userID, err := store.SaveUser(UserRow{Username: "alice", OnionAddress: "alice.onion"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.OpenAccount(userID, nil); err != nil {
+		t.Fatal(err)
+	}
+	bobKey, _ := testPublicKey(t, "bob")
+	contact, err := store.SaveContact(userID, "bob", "bob.onion", []byte(bobKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	if _, err := store.QueueMessage(userID, contact, "alice", []byte("hi"), []byte("payload"), "m1", now, now.Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	state := func() string {
+		messages, err := store.GetMessages(userID, contact.ID)
+		if err != nil || len(messages) != 1 {
+			t.Fatalf("GetMessages returned %v, %v", messages, err)
+		}
+		return messages[0].State
+	}
+
+	entries, err := store.GetDueOutbox(userID, now)
+	if err != nil || len(entries) != 1 {
+		t.Fatalf("GetDueOutbox returned %v, %v", entries, err)
+	}
+	if err := store.RetryOutbox(entries[0], now, "peer offline"); err != nil {
+		t.Fatal(err)
+	}
+	if got := state(); got != MessageQueued {
+		t.Errorf("state after a failed attempt is %q", got)
+	}
+
+	if err := store.FinishOutbox(entries[0], MessageSent); err != nil {
+		t.Fatal(err)
+	}
+	if got := state(); got != MessageSent {
+		t.Errorf("state after the peer accepted it is %q", got)
+	}
+
+	if err := store.RecordReceipt(userID, contact.ID, DeliveredReceipt, []string{"m1"}, now); err != nil {
+		t.Fatal(err)
+	}
+	if got := state(); got != MessageDelivered {
+		t.Errorf("state after the receipt is %q", got)
+	}
+}
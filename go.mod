@@ -3,12 +3,15 @@ module sote
 go 1.21.10
 
 require (
-	github.com/mattn/go-sqlite3 v1.14.22
+	github.com/ProtonMail/gopenpgp/v2 v2.7.5
+	github.com/cretz/bine v0.2.0
+	github.com/gdamore/tcell/v2 v2.7.4
+	github.com/mattn/go-runewidth v0.0.15
 	github.com/mdp/qrterminal/v3 v3.2.0
-	github.com/ProtonMail/gopenpgp/v2 v2.7.5 
-	github.com/cretz/bine v0.2.0 
-	github.com/urfave/cli/v2 v2.27.2 
-	golang.org/x/term v0.13.0
+	github.com/mutecomm/go-sqlcipher/v4 v4.4.2
+	github.com/urfave/cli/v2 v2.27.2
+	golang.org/x/crypto v0.7.0
+	golang.org/x/term v0.17.0
 )
 
 require (
@@ -16,12 +19,13 @@ require (
 	github.com/ProtonMail/go-mime v0.0.0-20230322103455-7d82a3887f2f // indirect
 	github.com/cloudflare/circl v1.3.3 // indirect
 	github.com/cpuguy83/go-md2man/v2 v2.0.4 // indirect
+	github.com/gdamore/encoding v1.0.0 // indirect
+	github.com/lucasb-eyer/go-colorful v1.2.0 // indirect
 	github.com/pkg/errors v0.9.1 // indirect
+	github.com/rivo/uniseg v0.4.3 // indirect
 	github.com/russross/blackfriday/v2 v2.1.0 // indirect
 	github.com/xrash/smetrics v0.0.0-20240312152122-5f08fbb34913 // indirect
-	golang.org/x/crypto v0.7.0 // indirect
-	golang.org/x/net v0.8.0 // indirect
-	golang.org/x/sys v0.14.0 // indirect
-	golang.org/x/text v0.8.0 // indirect
+	golang.org/x/sys v0.17.0 // indirect
+	golang.org/x/text v0.14.0 // indirect
 	rsc.io/qr v0.2.0 // indirect
 )
@@ -0,0 +1,475 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sote/db"
+	"sote/tor"
+	"sote/user"
+	"sync"
+	"time"
+)
+
+// bootstrapTimeout is how long login waits for an account's tor to bootstrap
+const bootstrapTimeout = 2 * time.Minute
+
+// account is a logged in user served by this node
+type account struct {
+	User      *user.User
+	TorConfig *tor.Config
+	Tor       *tor.TorProcess
+	// onionKey is the onion service's key, it signs peer requests
+	onionKey string
+
+	peerServer *http.Server
+	// ready is closed once activateAccount finished, activateErr tells whether it failed
+	ready       chan struct{}
+	activateErr error
+	// stop is closed when the account is deactivated, wakeReplies and outboxWake
+	// trigger deliverContactReplies and deliverOutbox
+	stop        chan struct{}
+	wakeReplies chan struct{}
+	outboxWake  chan struct{}
+
+	// subscribers receive the account's events, see events.go
+	subscribers   map[chan event]struct{}
+	subscribersMu sync.Mutex
+}
+
+// accountContextKey stores the account a peer connection belongs to
+type accountContextKey struct{}
+
+// startOnion starts the account's tor and publishes its onion service. Handler tests replace it
+// together with peerTransport, which carries peer requests instead of the account's tor when set.
+var startOnion = func(acc *account, onionKey string) error {
+	if err := acc.Tor.Start(bootstrapTimeout); err != nil {
+		return err
+	}
+	_, err := acc.Tor.AddOnion(onionKey, tor.OnionPort, acc.TorConfig.ServiceAddress())
+	return err
+}
+
+var peerTransport http.RoundTripper
+
+// accounts holds every active account by username
+var accounts = make(map[string]*account)
+var accountsMu sync.Mutex
+
+// activateAccount registers a logged in user, starts its tor and adds its onion service.
+// If the user is already active the running account is returned, once it finished starting.
+func activateAccount(u *user.User, onionKey string) (*account, error) {
+	accountsMu.Lock()
+	if acc, ok := accounts[u.Username]; ok {
+		accountsMu.Unlock()
+		<-acc.ready
+		if acc.activateErr != nil {
+			return nil, acc.activateErr
+		}
+		return acc, nil
+	}
+
+	acc, err := prepareAccount(u)
+	if err != nil {
+		accountsMu.Unlock()
+		return nil, err
+	}
+	acc.onionKey = onionKey
+	// Register before unlocking, bootstrapping may take a while
+	accounts[u.Username] = acc
+	accountsMu.Unlock()
+
+	// The account's contacts and messages can only be read while it is active
+	err = openAccountData(u)
+	if err == nil {
+		err = startOnion(acc, onionKey)
+	}
+	if err != nil {
+		acc.activateErr = err
+		close(acc.ready)
+		deactivateAccount(u.Username)
+		return nil, err
+	}
+	close(acc.ready)
+	go acc.deliverContactReplies()
+	go acc.deliverOutbox()
+	fmt.Printf("Account %s is active (SocksPort %d, ControlPort %d, ServicePort %d)\n", u.Username, acc.TorConfig.SocksPort, acc.TorConfig.ControlPort, acc.TorConfig.ServicePort) // Debug print
+	return acc, nil
+}
+
+// prepareAccount allocates the account's ports, writes its torrc and starts its peer listener.
+// accountsMu must be held by the caller.
+func prepareAccount(u *user.User) (*account, error) {
+	socksPort, controlPort, servicePort, err := store.GetTorPorts(u.Username)
+	if err != nil {
+		return nil, err
+	}
+	config := tor.NewConfig(u.TorrcFilePath, socksPort, controlPort, servicePort)
+	if err := applyBridges(config); err != nil {
+		return nil, err
+	}
+	torProcess := tor.NewTorProcess(config)
+
+	// A tor left over from an earlier run keeps the ports it was started with
+	torRunning := torProcess.IsRunning()
+	changed, err := config.AllocatePorts(torRunning)
+	if err != nil {
+		return nil, fmt.Errorf("error allocating ports: %v", err)
+	}
+	if changed {
+		err = store.UpdateTorPorts(u.Username, config.SocksPort, config.ControlPort, config.ServicePort)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if !torRunning {
+		if err := config.WriteTorrc(); err != nil {
+			return nil, err
+		}
+	}
+
+	acc := &account{
+		User:        u,
+		TorConfig:   config,
+		Tor:         torProcess,
+		ready:       make(chan struct{}),
+		stop:        make(chan struct{}),
+		wakeReplies: make(chan struct{}, 1),
+		outboxWake:  make(chan struct{}, 1),
+		subscribers: make(map[chan event]struct{}),
+	}
+
+	// The onion service forwards to this account's own peer listener
+	listener, err := net.Listen("tcp", config.ServiceAddress())
+	if err != nil {
+		return nil, err
+	}
+	acc.peerServer = &http.Server{
+		Handler:   peerMux,
+		TLSConfig: &tls.Config{Certificates: []tls.Certificate{peerCertificate}},
+		BaseContext: func(net.Listener) context.Context {
+			return context.WithValue(context.Background(), accountContextKey{}, acc)
+		},
+	}
+	go func() {
+		err := acc.peerServer.ServeTLS(listener, "", "")
+		if err != nil && err != http.ErrServerClosed {
+			fmt.Println("Peer listener of", u.Username, "stopped:", err) // Debug print
+		}
+	}()
+	return acc, nil
+}
+
+// applyBridges adds the bridges stored by `sote-client bridges` to a tor config
+func applyBridges(config *tor.Config) error {
+	bridges, err := store.GetBridges()
+	if err != nil {
+		return err
+	}
+	for _, bridge := range bridges {
+		config.Bridges = append(config.Bridges, bridge.Line)
+	}
+	if len(config.Bridges) == 0 {
+		return nil
+	}
+
+	config.TransportPlugin, err = store.GetSetting(db.TransportPluginSetting)
+	if err != nil {
+		return err
+	}
+	if config.TransportPlugin == "" {
+		config.TransportPlugin = tor.DefaultTransportPlugin()
+	}
+	if config.TransportPlugin == "" {
+		fmt.Println("Warning: bridges are configured but no pluggable transport client was found") // Debug print
+	}
+	return nil
+}
+
+// deactivateAccount stops the tor of an account and removes it from the registry
+func deactivateAccount(username string) error {
+	accountsMu.Lock()
+	acc, ok := accounts[username]
+	delete(accounts, username)
+	accountsMu.Unlock()
+
+	if !ok {
+		return nil
+	}
+	fmt.Println("Deactivating account:", username) // Debug print
+	close(acc.stop)
+	acc.peerServer.Close()
+	err := acc.Tor.Stop()
+	if closeErr := store.CloseAccount(acc.User.ID); closeErr != nil {
+		fmt.Println("Error closing account database:", closeErr) // Debug print
+	}
+	acc.User.Lock()
+	return err
+}
+
+// openAccountData opens the account's encrypted database. Its data key is stored encrypted with the
+// key derived from the password, so changing the password doesn't touch the data. Accounts that
+// have no data key yet get one and their contacts and messages are moved out of localDB.db.
+func openAccountData(u *user.User) error {
+	encryptedKey, err := store.GetDataKey(u.Username)
+	if err != nil {
+		return err
+	}
+	var dataKey []byte
+	if encryptedKey == nil {
+		dataKey = make([]byte, 32)
+		if _, err := rand.Read(dataKey); err != nil {
+			return err
+		}
+		encryptedKey, err = user.EncryptAES256(dataKey, u.EncryptionKey)
+		if err != nil {
+			return err
+		}
+		if err := store.SetDataKey(u.Username, encryptedKey); err != nil {
+			return err
+		}
+	} else {
+		dataKey, err = user.DecryptAES256(encryptedKey, u.EncryptionKey)
+		if err != nil {
+			return fmt.Errorf("error decrypting data key: %v", err)
+		}
+	}
+	return store.OpenAccount(u.ID, dataKey)
+}
+
+// deactivateAllAccounts stops every account's tor, used when the node exits
+func deactivateAllAccounts() {
+	accountsMu.Lock()
+	var usernames []string
+	for username := range accounts {
+		usernames = append(usernames, username)
+	}
+	accountsMu.Unlock()
+
+	for _, username := range usernames {
+		if err := deactivateAccount(username); err != nil {
+			fmt.Println("Error stopping tor of", username, err) // Debug print
+		}
+	}
+}
+
+// loginLocks hold one lock per account that serializes its logins
+var (
+	loginLocks   = make(map[string]*sync.Mutex)
+	loginLocksMu sync.Mutex
+)
+
+// lockLogin takes the login lock of an account, the returned function releases it
+func lockLogin(username string) func() {
+	loginLocksMu.Lock()
+	mu, ok := loginLocks[username]
+	if !ok {
+		mu = &sync.Mutex{}
+		loginLocks[username] = mu
+	}
+	loginLocksMu.Unlock()
+	mu.Lock()
+	return mu.Unlock
+}
+
+// unlockUser derives the key that encrypts the user's secrets from the password
+// and unlocks the private key, which stays in memory until the account is deactivated.
+// Accounts from before Argon2id get a new password hash and key, and everything
+// encrypted with the old SHA-256 key is encrypted again.
+func unlockUser(u *user.User, password string) error {
+	encodedParams, err := store.GetKDFParams(u.Username)
+	if err != nil {
+		return err
+	}
+	if encodedParams != "" && !user.IsLegacyPasswordHash(u.Password) {
+		params, err := user.ParseKDFParams(encodedParams)
+		if err != nil {
+			return err
+		}
+		u.KDFParams = encodedParams
+		u.EncryptionKey = user.DeriveKey(password, params)
+	} else if err := migrateLegacyKeys(u, password); err != nil {
+		return err
+	}
+
+	u.KeyRing, err = user.UnlockKeyRing(u.PrivateKey, u.EncryptionKey)
+	return err
+}
+
+// migrateLegacyKeys moves an account from the SHA-256 password hash and key to Argon2id
+func migrateLegacyKeys(u *user.User, password string) error {
+	migrator, ok := store.(db.LegacyMigrator)
+	if !ok {
+		return errors.New("this store can't migrate accounts from before Argon2id")
+	}
+	legacyKey := user.LegacyKey(password)
+
+	params, err := user.NewKDFParams()
+	if err != nil {
+		return err
+	}
+	encryptionKey := user.DeriveKey(password, params)
+	passwordHash, err := user.HashPassword(password)
+	if err != nil {
+		return err
+	}
+
+	privateKey, err := user.DecryptAES256(u.PrivateKey, legacyKey)
+	if err != nil {
+		return fmt.Errorf("error decrypting private key: %v", err)
+	}
+	privateKey, err = user.EncryptAES256(privateKey, encryptionKey)
+	if err != nil {
+		return err
+	}
+
+	onionPrivateKey, err := store.GetOnionPrivateKey(u.Username)
+	if err != nil {
+		return err
+	}
+	if onionPrivateKey != nil {
+		onionKey, err := user.DecryptAES256(onionPrivateKey, legacyKey)
+		if err != nil {
+			return fmt.Errorf("error decrypting onion key: %v", err)
+		}
+		onionPrivateKey, err = user.EncryptAES256(onionKey, encryptionKey)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Sent messages are stored encrypted with the sender's own key
+	sentMessages, err := migrator.GetSentMessages(u.ID)
+	if err != nil {
+		return err
+	}
+	var migrated []db.Message
+	for _, msg := range sentMessages {
+		plain, err := user.DecryptAES256(msg.Message, legacyKey)
+		if err != nil {
+			fmt.Println("Skipping sent message that can't be decrypted:", msg.ID) // Debug print
+			continue
+		}
+		msg.Message, err = user.EncryptAES256(plain, encryptionKey)
+		if err != nil {
+			return err
+		}
+		migrated = append(migrated, msg)
+	}
+
+	err = migrator.UpdateUserKeys(u.Username, passwordHash, params.String(), privateKey, onionPrivateKey, migrated)
+	if err != nil {
+		return err
+	}
+
+	u.Password = passwordHash
+	u.PrivateKey = privateKey
+	u.KDFParams = params.String()
+	u.EncryptionKey = encryptionKey
+	fmt.Println("Migrated", u.Username, "to Argon2id") // Debug print
+	return nil
+}
+
+// loadOnionKey decrypts the onion service key of a user.
+// Accounts from before ADD_ONION still have a HiddenServiceDir, their key is moved
+// into the database encrypted under the password and the directory is removed.
+func loadOnionKey(u *user.User) (string, error) {
+	encryptedKey, err := store.GetOnionPrivateKey(u.Username)
+	if err != nil {
+		return "", err
+	}
+	if encryptedKey != nil {
+		key, err := user.DecryptAES256(encryptedKey, u.EncryptionKey)
+		if err != nil {
+			return "", fmt.Errorf("error decrypting onion key: %v", err)
+		}
+		return string(key), nil
+	}
+
+	hiddenServiceDir, key, err := tor.HiddenServiceKey(u.TorrcFilePath)
+	if err != nil {
+		return "", fmt.Errorf("error reading hidden service key: %v", err)
+	}
+	if hiddenServiceDir == "" {
+		return "", errors.New("account has no onion key")
+	}
+	encryptedKey, err = user.EncryptAES256([]byte(key), u.EncryptionKey)
+	if err != nil {
+		return "", err
+	}
+	torrcFilePath, err := tor.CreateTorDir()
+	if err != nil {
+		return "", err
+	}
+	err = store.UpdateOnionPrivateKey(u.Username, encryptedKey, torrcFilePath)
+	if err != nil {
+		return "", err
+	}
+	u.TorrcFilePath = torrcFilePath
+
+	if err := os.RemoveAll(hiddenServiceDir); err != nil {
+		fmt.Println("Error removing hidden service directory:", err) // Debug print
+	}
+	fmt.Println("Moved onion key of", u.Username, "into the database") // Debug print
+	return key, nil
+}
+
+// getAccount returns the active account of the given username
+func getAccount(username string) (*account, error) {
+	accountsMu.Lock()
+	acc, ok := accounts[username]
+	accountsMu.Unlock()
+	if !ok {
+		return nil, errors.New("user is not logged in")
+	}
+	select {
+	case <-acc.ready:
+	default:
+		return nil, errors.New("account is still starting")
+	}
+	if acc.activateErr != nil {
+		return nil, acc.activateErr
+	}
+	return acc, nil
+}
+
+// accountFromSession resolves the account of a local request by its session token
+func accountFromSession(r *http.Request) (*account, error) {
+	sess, ok := getSession(r)
+	if !ok {
+		return nil, errors.New("no valid session")
+	}
+	return getAccount(sess.Username)
+}
+
+// accountFromPeer resolves the account whose onion service a peer request came in on
+func accountFromPeer(r *http.Request) (*account, error) {
+	acc, ok := r.Context().Value(accountContextKey{}).(*account)
+	if !ok {
+		return nil, errors.New("request did not arrive on an account's onion service")
+	}
+	return acc, nil
+}
+
+// httpClient returns a client that reaches onion services through the account's tor
+func (acc *account) httpClient() (*http.Client, error) {
+	if peerTransport != nil {
+		return &http.Client{Transport: peerTransport}, nil
+	}
+	proxyURL, err := url.Parse(acc.TorConfig.ProxyURL())
+	if err != nil {
+		return nil, err
+	}
+	return &http.Client{
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+			Proxy:           http.ProxyURL(proxyURL),
+		},
+	}, nil
+}
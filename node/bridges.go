@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sote/db"
+	"sote/tor"
+)
+
+// listBridgesHandler returns the stored bridges and the pluggable transport client the node uses
+func listBridgesHandler(w http.ResponseWriter, r *http.Request) {
+	bridges, err := store.GetBridges()
+	if err != nil {
+		http.Error(w, "Failed to fetch bridges", http.StatusInternalServerError)
+		return
+	}
+	plugin, err := store.GetSetting(db.TransportPluginSetting)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	// Without a stored plugin the node looks for one in its own PATH
+	detected := plugin == ""
+	if detected {
+		plugin = tor.DefaultTransportPlugin()
+	}
+	if bridges == nil {
+		bridges = []db.Bridge{}
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"bridges":         bridges,
+		"transportPlugin": plugin,
+		"detected":        detected,
+	})
+}
+
+// addBridgesHandler stores the bridge lines of a file, a scanned QR payload or a single line
+func addBridgesHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Bridges string `json:"bridges"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	lines, err := tor.ParseBridgeLines(req.Bridges)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(lines) == 0 {
+		http.Error(w, "No bridge lines found", http.StatusBadRequest)
+		return
+	}
+	for _, line := range lines {
+		if err := store.SaveBridge(line); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	fmt.Printf("Added %d bridge(s)\n", len(lines)) // Debug print
+	json.NewEncoder(w).Encode(map[string][]string{"added": lines})
+}
+
+// removeBridgeHandler removes a stored bridge by its ID
+func removeBridgeHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		ID int `json:"id,string"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid bridge id", http.StatusBadRequest)
+		return
+	}
+	if err := store.DeleteBridge(req.ID); err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]int{"removed": req.ID})
+}
+
+// transportPluginHandler sets the pluggable transport client, an empty path detects one again
+func transportPluginHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Path string `json:"path"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// tor runs next to the node, the path must exist here
+	if req.Path != "" {
+		if _, err := os.Stat(req.Path); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if err := store.SetSetting(db.TransportPluginSetting, req.Path); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]string{"transportPlugin": req.Path})
+}
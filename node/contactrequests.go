@@ -0,0 +1,159 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sote/db"
+	"time"
+)
+
+// Delays between attempts to deliver the reply to an accepted contact request
+const (
+	contactReplyRetryDelay    = 30 * time.Second
+	contactReplyMaxRetryDelay = time.Hour
+)
+
+// listContactRequestsHandler returns the incoming contact requests waiting for an answer
+func listContactRequestsHandler(w http.ResponseWriter, r *http.Request) {
+	acc, err := accountFromSession(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	requests, err := store.GetContactRequests(acc.User.ID, db.IncomingContactRequest, db.ContactRequestPending)
+	if err != nil {
+		http.Error(w, "Failed to fetch contact requests", http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(requests)
+}
+
+// answerContactRequestHandler accepts or rejects a pending contact request.
+// The reply to an accepted request is delivered in the background.
+func answerContactRequestHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		ID     int  `json:"id"`
+		Accept bool `json:"accept"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	acc, err := accountFromSession(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	contactRequest, err := store.GetContactRequest(acc.User.ID, req.ID)
+	if err != nil || contactRequest.Direction != db.IncomingContactRequest || contactRequest.Status != db.ContactRequestPending {
+		http.Error(w, "Contact request not found", http.StatusNotFound)
+		return
+	}
+
+	if !req.Accept {
+		err = store.DeleteContactRequest(acc.User.ID, contactRequest.OnionAddress, db.IncomingContactRequest)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		fmt.Println("Contact request rejected:", contactRequest.ContactUsername) // Debug print
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	_, err = store.SaveContact(acc.User.ID, contactRequest.ContactUsername, contactRequest.OnionAddress, contactRequest.PublicKey)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	err = store.SetContactRequestStatus(acc.User.ID, contactRequest.ID, db.ContactRequestAccepted)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	fmt.Println("Contact request accepted:", contactRequest.ContactUsername) // Debug print
+
+	// Wake the delivery loop so the reply goes out right away
+	select {
+	case acc.wakeReplies <- struct{}{}:
+	default:
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// deliverContactReplies sends the account's contact data to everyone whose request it accepted.
+// Replies that can't be delivered are retried with backoff until the account is deactivated.
+func (acc *account) deliverContactReplies() {
+	retryDelay := make(map[int]time.Duration)
+	nextAttempt := make(map[int]time.Time)
+	ticker := time.NewTicker(contactReplyRetryDelay)
+	defer ticker.Stop()
+
+	for {
+		requests, err := store.GetContactRequests(acc.User.ID, db.IncomingContactRequest, db.ContactRequestAccepted)
+		if err != nil {
+			fmt.Println("Error reading accepted contact requests:", err) // Debug print
+		}
+		for _, req := range requests {
+			if time.Now().Before(nextAttempt[req.ID]) {
+				continue
+			}
+			err := acc.sendContactReply(req)
+			if err == nil {
+				delete(retryDelay, req.ID)
+				delete(nextAttempt, req.ID)
+				continue
+			}
+
+			delay := retryDelay[req.ID]
+			if delay == 0 {
+				delay = contactReplyRetryDelay
+			} else if delay < contactReplyMaxRetryDelay {
+				delay *= 2
+			}
+			retryDelay[req.ID] = delay
+			nextAttempt[req.ID] = time.Now().Add(delay)
+			fmt.Printf("Failed to deliver contact reply to %s (%v), retrying in %v\n", req.OnionAddress, err, delay)
+		}
+
+		select {
+		case <-acc.stop:
+			return
+		case <-acc.wakeReplies:
+		case <-ticker.C:
+		}
+	}
+}
+
+// sendContactReply sends the account's contact data to the requester of an accepted request
+func (acc *account) sendContactReply(req db.ContactRequest) error {
+	jsonData, err := json.Marshal(map[string]interface{}{
+		"username":     acc.User.Username,
+		"onionAddress": acc.User.OnionAddress,
+		"publicKey":    acc.User.PublicKey,
+	})
+	if err != nil {
+		return err
+	}
+
+	resp, err := acc.postToPeer(req.OnionAddress, "/receive-contact-accept", jsonData)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		fmt.Println("Contact reply delivered to:", req.ContactUsername) // Debug print
+	case http.StatusForbidden:
+		// The requester no longer waits for us, retrying won't change that
+		fmt.Println("Contact reply refused by:", req.ContactUsername) // Debug print
+	default:
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return store.DeleteContactRequest(acc.User.ID, req.OnionAddress, db.IncomingContactRequest)
+}
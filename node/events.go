@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// Types of the events pushed to clients on /events
+const (
+	messageEvent        = "message"
+	contactRequestEvent = "contact-request"
+	contactEvent        = "contact"
+	deliveryEvent       = "delivery"
+	receiptEvent        = "receipt"
+	groupEvent          = "group"
+)
+
+// eventHeartbeat keeps idle event streams open
+const eventHeartbeat = 30 * time.Second
+
+// event is pushed to every client subscribed to an account's events
+type event struct {
+	Type string      `json:"type"`
+	Data interface{} `json:"data"`
+}
+
+// subscribe returns a channel that receives the account's events until unsubscribe is called
+func (acc *account) subscribe() chan event {
+	ch := make(chan event, 64)
+	acc.subscribersMu.Lock()
+	acc.subscribers[ch] = struct{}{}
+	acc.subscribersMu.Unlock()
+	return ch
+}
+
+// unsubscribe stops sending events to a channel returned by subscribe
+func (acc *account) unsubscribe(ch chan event) {
+	acc.subscribersMu.Lock()
+	delete(acc.subscribers, ch)
+	acc.subscribersMu.Unlock()
+}
+
+// publish sends an event to every subscriber, subscribers that don't keep up miss it
+func (acc *account) publish(eventType string, data interface{}) {
+	acc.subscribersMu.Lock()
+	defer acc.subscribersMu.Unlock()
+	for ch := range acc.subscribers {
+		select {
+		case ch <- event{Type: eventType, Data: data}:
+		default:
+		}
+	}
+}
+
+// eventsHandler streams the account's events to the client as server-sent events
+func eventsHandler(w http.ResponseWriter, r *http.Request) {
+	acc, err := accountFromSession(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+
+	events := acc.subscribe()
+	defer acc.unsubscribe(events)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(eventHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case ev := <-events:
+			data, err := json.Marshal(ev)
+			if err != nil {
+				fmt.Println("Error encoding event:", err) // Debug print
+				continue
+			}
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", ev.Type, data)
+		case <-heartbeat.C:
+			fmt.Fprint(w, ": heartbeat\n\n")
+		case <-r.Context().Done():
+			return
+		case <-acc.stop:
+			return
+		}
+		flusher.Flush()
+	}
+}
@@ -0,0 +1,571 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sote/db"
+	"sote/user"
+	"time"
+)
+
+// groupMembership is the member list the creator of a group signs. Every change gets a higher version,
+// members only accept versions signed by the creator they first got the group from.
+type groupMembership struct {
+	ID      string            `json:"id"`
+	Name    string            `json:"name"`
+	Creator string            `json:"creator"`
+	Version int               `json:"version"`
+	Members []groupMemberData `json:"members"`
+}
+
+type groupMemberData struct {
+	Username     string `json:"username"`
+	OnionAddress string `json:"onionAddress"`
+	PublicKey    string `json:"publicKey"`
+}
+
+// groupUpdate is the body of /receive-group-update
+type groupUpdate struct {
+	Membership []byte `json:"membership"`
+	Signature  []byte `json:"signature"`
+}
+
+// createGroupHandler creates a group with the account as its creator and only member
+func createGroupHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Name string `json:"name"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Name == "" {
+		http.Error(w, "Group name is required", http.StatusBadRequest)
+		return
+	}
+
+	acc, err := accountFromSession(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	// Group IDs are random UUIDs like message IDs
+	groupID, err := newMessageID()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	group := db.Group{
+		GroupID:             groupID,
+		Name:                req.Name,
+		CreatorOnionAddress: normalizeOnion(acc.User.OnionAddress),
+		CreatorPublicKey:    acc.User.PublicKey,
+		Members: []db.GroupMember{{
+			Username:     acc.User.Username,
+			OnionAddress: normalizeOnion(acc.User.OnionAddress),
+			PublicKey:    acc.User.PublicKey,
+		}},
+	}
+	if err := acc.publishGroupVersion(&group, nil); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	fmt.Println("Group created:", group.Name) // Debug print
+	json.NewEncoder(w).Encode(group)
+}
+
+// listGroupsHandler returns the account's groups with their members
+func listGroupsHandler(w http.ResponseWriter, r *http.Request) {
+	acc, err := accountFromSession(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	groups, err := store.GetGroups(acc.User.ID)
+	if err != nil {
+		http.Error(w, "Failed to fetch groups", http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(groups)
+}
+
+// inviteToGroupHandler adds a contact to a group the account created
+func inviteToGroupHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Group   string `json:"group"`
+		Contact string `json:"contact"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	acc, err := accountFromSession(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	group, ok := acc.ownGroup(w, req.Group)
+	if !ok {
+		return
+	}
+
+	contact, err := store.GetContact(acc.User.ID, req.Contact)
+	if err != nil || contact.PublicKey == nil {
+		http.Error(w, "Contact not found", http.StatusNotFound)
+		return
+	}
+	for _, member := range group.Members {
+		if member.OnionAddress == normalizeOnion(contact.OnionAddress) {
+			json.NewEncoder(w).Encode(group)
+			return
+		}
+	}
+
+	group.Members = append(group.Members, db.GroupMember{
+		Username:     contact.Username,
+		OnionAddress: normalizeOnion(contact.OnionAddress),
+		PublicKey:    contact.PublicKey,
+	})
+	if err := acc.publishGroupVersion(&group, nil); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	fmt.Printf("Invited %s to group %s\n", contact.Username, group.Name) // Debug print
+	json.NewEncoder(w).Encode(group)
+}
+
+// removeFromGroupHandler removes a member from a group the account created
+func removeFromGroupHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Group  string `json:"group"`
+		Member string `json:"member"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	acc, err := accountFromSession(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	group, ok := acc.ownGroup(w, req.Group)
+	if !ok {
+		return
+	}
+
+	var removed []db.GroupMember
+	var members []db.GroupMember
+	for _, member := range group.Members {
+		if member.Username == req.Member || member.OnionAddress == normalizeOnion(req.Member) {
+			removed = append(removed, member)
+			continue
+		}
+		members = append(members, member)
+	}
+	if len(removed) == 0 {
+		http.Error(w, "Member not found", http.StatusNotFound)
+		return
+	}
+	for _, member := range removed {
+		if member.OnionAddress == group.CreatorOnionAddress {
+			http.Error(w, "The creator can't leave the group", http.StatusBadRequest)
+			return
+		}
+	}
+
+	// Removed members get the new list too, it tells them they are out
+	group.Members = members
+	if err := acc.publishGroupVersion(&group, removed); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	fmt.Printf("Removed %s from group %s\n", req.Member, group.Name) // Debug print
+	json.NewEncoder(w).Encode(group)
+}
+
+// ownGroup returns a group the account created, it writes the error response otherwise
+func (acc *account) ownGroup(w http.ResponseWriter, groupID string) (db.Group, bool) {
+	group, err := store.GetGroup(acc.User.ID, groupID)
+	if errors.Is(err, db.ErrNotFound) {
+		http.Error(w, "Group not found", http.StatusNotFound)
+		return group, false
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return group, false
+	}
+	if group.CreatorOnionAddress != normalizeOnion(acc.User.OnionAddress) {
+		http.Error(w, "Only the creator of the group can change its members", http.StatusForbidden)
+		return group, false
+	}
+	return group, true
+}
+
+// publishGroupVersion signs the next version of a group the account created, stores it and
+// queues it for every other member and for removed members
+func (acc *account) publishGroupVersion(group *db.Group, removed []db.GroupMember) error {
+	group.Version++
+	membership := groupMembership{
+		ID:      group.GroupID,
+		Name:    group.Name,
+		Creator: group.CreatorOnionAddress,
+		Version: group.Version,
+	}
+	for _, member := range group.Members {
+		membership.Members = append(membership.Members, groupMemberData{
+			Username:     member.Username,
+			OnionAddress: member.OnionAddress,
+			PublicKey:    string(member.PublicKey),
+		})
+	}
+	data, err := json.Marshal(membership)
+	if err != nil {
+		return err
+	}
+	signature, err := user.SignDetached(acc.User.KeyRing, data)
+	if err != nil {
+		return err
+	}
+	if err := store.SaveGroup(acc.User.ID, *group, data, signature); err != nil {
+		return err
+	}
+
+	payload, err := json.Marshal(groupUpdate{Membership: data, Signature: signature})
+	if err != nil {
+		return err
+	}
+	for _, member := range append(group.Members, removed...) {
+		if member.OnionAddress == group.CreatorOnionAddress {
+			continue
+		}
+		err := store.QueueGroupUpdate(acc.User.ID, member.OnionAddress, payload, time.Now().Add(outboxMaxAge))
+		if err != nil {
+			return err
+		}
+	}
+	acc.wakeOutbox()
+	return nil
+}
+
+// deliverGroupUpdate makes one delivery attempt of a signed member list
+func (acc *account) deliverGroupUpdate(queued db.QueuedGroupUpdate) {
+	resp, err := acc.postToPeer(queued.OnionAddress, "/receive-group-update", queued.Payload)
+	if err == nil {
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusOK || peerRefused(resp.StatusCode) {
+			if err := store.DeleteGroupUpdate(queued); err != nil {
+				fmt.Println("Error removing group update:", err) // Debug print
+			}
+			return
+		}
+		err = fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	if time.Now().After(queued.Expires) {
+		fmt.Printf("Giving up on group update to %s: %v\n", queued.OnionAddress, err)
+		if err := store.DeleteGroupUpdate(queued); err != nil {
+			fmt.Println("Error removing group update:", err) // Debug print
+		}
+		return
+	}
+	delay := outboxDelay(queued.Attempts)
+	fmt.Printf("Failed to deliver group update to %s (%v), retrying in %v\n", queued.OnionAddress, err, delay)
+	if err := store.RetryGroupUpdate(queued, time.Now().Add(delay)); err != nil {
+		fmt.Println("Error updating group update:", err) // Debug print
+	}
+}
+
+// receiveGroupUpdateHandler stores a member list signed by the creator of a group.
+// Groups are only joined when a contact invites the account.
+func receiveGroupUpdateHandler(w http.ResponseWriter, r *http.Request) {
+	var req groupUpdate
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	acc, err := accountFromPeer(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	creator, err := contactFromPeer(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	if err := user.VerifyDetached(creator.PublicKey, req.Membership, req.Signature); err != nil {
+		http.Error(w, "Member list signature could not be verified", http.StatusUnprocessableEntity)
+		return
+	}
+	var membership groupMembership
+	if err := json.Unmarshal(req.Membership, &membership); err != nil || membership.ID == "" || membership.Version < 1 {
+		http.Error(w, "Invalid member list", http.StatusBadRequest)
+		return
+	}
+	if normalizeOnion(membership.Creator) != normalizeOnion(creator.OnionAddress) {
+		http.Error(w, "Member lists must be sent by the creator of the group", http.StatusUnprocessableEntity)
+		return
+	}
+
+	existing, err := store.GetGroup(acc.User.ID, membership.ID)
+	switch {
+	case err == nil:
+		if existing.CreatorOnionAddress != normalizeOnion(creator.OnionAddress) {
+			http.Error(w, "Member lists must be sent by the creator of the group", http.StatusUnprocessableEntity)
+			return
+		}
+		if membership.Version <= existing.Version {
+			// Redelivered or outdated, the stored list is newer
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+	case !errors.Is(err, db.ErrNotFound):
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	group := db.Group{
+		GroupID:             membership.ID,
+		Name:                membership.Name,
+		CreatorOnionAddress: normalizeOnion(creator.OnionAddress),
+		CreatorPublicKey:    creator.PublicKey,
+		Version:             membership.Version,
+	}
+	isMember := false
+	for _, member := range membership.Members {
+		onionAddress := normalizeOnion(member.OnionAddress)
+		if onionAddress == normalizeOnion(acc.User.OnionAddress) {
+			isMember = true
+		}
+		group.Members = append(group.Members, db.GroupMember{
+			Username:     member.Username,
+			OnionAddress: onionAddress,
+			PublicKey:    []byte(member.PublicKey),
+		})
+	}
+
+	if !isMember {
+		if existing.GroupID != "" {
+			if err := store.DeleteGroup(acc.User.ID, membership.ID); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			fmt.Println("Removed from group:", membership.Name) // Debug print
+			acc.publish(groupEvent, map[string]interface{}{"id": membership.ID, "name": membership.Name, "removed": true})
+		}
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	if err := store.SaveGroup(acc.User.ID, group, req.Membership, req.Signature); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	fmt.Printf("Group %s updated by %s\n", group.Name, creator.Username) // Debug print
+	acc.publish(groupEvent, map[string]interface{}{"id": group.GroupID, "name": group.Name, "version": group.Version})
+	w.WriteHeader(http.StatusOK)
+}
+
+// sendGroupMessageHandler encrypts a message once to every other member of a group and queues it for each of them
+func sendGroupMessageHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Group   string `json:"group"`
+		Message string `json:"message"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	acc, err := accountFromSession(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	group, err := store.GetGroup(acc.User.ID, req.Group)
+	if err != nil {
+		http.Error(w, "Group not found", http.StatusNotFound)
+		return
+	}
+
+	var publicKeys [][]byte
+	var onionAddresses []string
+	for _, member := range group.Members {
+		if member.OnionAddress == normalizeOnion(acc.User.OnionAddress) {
+			continue
+		}
+		publicKeys = append(publicKeys, member.PublicKey)
+		onionAddresses = append(onionAddresses, member.OnionAddress)
+	}
+
+	var encryptedMessage []byte
+	if len(publicKeys) > 0 {
+		encryptedMessage, err = user.EncryptMessageToAll([]byte(req.Message), publicKeys, acc.User.KeyRing)
+		if err != nil {
+			http.Error(w, "Failed to encrypt message", http.StatusInternalServerError)
+			return
+		}
+	}
+	ownEncryptedMessage, err := user.EncryptAES256([]byte(req.Message), acc.User.EncryptionKey)
+	if err != nil {
+		http.Error(w, "Failed to encrypt message", http.StatusInternalServerError)
+		return
+	}
+
+	messageID, err := newMessageID()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	sentAt := time.Now()
+	seq, err := store.QueueGroupMessage(acc.User.ID, acc.User.Username, group.GroupID, onionAddresses, ownEncryptedMessage, encryptedMessage, messageID, sentAt, sentAt.Add(outboxMaxAge))
+	if err != nil {
+		http.Error(w, "Failed to save message", http.StatusInternalServerError)
+		return
+	}
+	acc.wakeOutbox()
+	fmt.Println("Message queued for group:", group.Name) // Debug print
+
+	state := db.MessageQueued
+	if len(onionAddresses) == 0 {
+		state = db.MessageSent
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"id":    messageID,
+		"seq":   seq,
+		"state": state,
+	})
+}
+
+// receiveGroupMessageHandler stores a message from a member of a group.
+// Members don't have to be contacts, the request must be signed with the key the creator listed for them.
+func receiveGroupMessageHandler(w http.ResponseWriter, r *http.Request) {
+	acc, err := accountFromPeer(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	onionAddress, body, err := readPeerRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	var req peerMessage
+	if err := json.Unmarshal(body, &req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.ID == "" || len(req.ID) > 64 || req.Seq < 1 || req.Group == "" {
+		http.Error(w, "Message has no valid id, sequence number or group", http.StatusBadRequest)
+		return
+	}
+
+	sender, err := store.GetGroupMember(acc.User.ID, req.Group, onionAddress)
+	if err != nil || onionAddress == normalizeOnion(acc.User.OnionAddress) {
+		fmt.Println("Rejected group message from non-member:", onionAddress) // Debug print
+		http.Error(w, "Not a member of the group", http.StatusForbidden)
+		return
+	}
+	if err := verifyPeerRequest(r, acc, body, sender.PublicKey); err != nil {
+		fmt.Println("Rejected group message from", sender.Username, err) // Debug print
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	plain, err := user.DecryptMessage([]byte(req.Message), acc.User.KeyRing, sender.PublicKey)
+	if err != nil {
+		fmt.Println("Rejected group message with invalid signature from:", sender.Username) // Debug print
+		http.Error(w, "Message signature could not be verified", http.StatusUnprocessableEntity)
+		return
+	}
+
+	// Members are stored by their key like contacts, the username they chose may be anyone's
+	fingerprint, err := user.Fingerprint(sender.PublicKey)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	inserted, err := store.SaveGroupMessage(acc.User.ID, acc.User.Username, fingerprint, req.Group, []byte(req.Message), req.ID, req.SentAt, req.Seq)
+	if err != nil {
+		http.Error(w, "Failed to save message", http.StatusInternalServerError)
+		return
+	}
+	if inserted {
+		name := acc.memberName(fingerprint, sender.Username)
+		fmt.Printf("New group message received for %s from %s\n", acc.User.Username, name)
+		acc.publish(messageEvent, map[string]interface{}{
+			"id":          req.ID,
+			"sender":      name,
+			"fingerprint": fingerprint,
+			"receiver":    req.Group,
+			"group":       req.Group,
+			"message":     plain,
+			"sentAt":      req.SentAt,
+			"seq":         req.Seq,
+		})
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// memberName is the name the owner sees for a group member: the nickname of a contact, else the
+// name the member chose with the start of their fingerprint, so members who chose the same name differ
+func (acc *account) memberName(fingerprint, username string) string {
+	if contact, err := store.GetContact(acc.User.ID, fingerprint); err == nil {
+		return contact.Nickname
+	}
+	if len(fingerprint) > 8 {
+		fingerprint = fingerprint[:8]
+	}
+	return fmt.Sprintf("%s (%s)", username, fingerprint)
+}
+
+// fetchGroupMessagesHandler returns the decrypted messages of a group conversation
+func fetchGroupMessagesHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Group string `json:"group"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	acc, err := accountFromSession(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	group, err := store.GetGroup(acc.User.ID, req.Group)
+	if err != nil {
+		http.Error(w, "Group not found", http.StatusNotFound)
+		return
+	}
+	messages, err := store.GetGroupMessages(acc.User.ID, req.Group)
+	if err != nil {
+		http.Error(w, "Failed to fetch messages", http.StatusInternalServerError)
+		return
+	}
+	if err := acc.decryptMessages(messages); err != nil {
+		http.Error(w, "Failed to decrypt messages", http.StatusInternalServerError)
+		return
+	}
+
+	// Received messages are stored under the member's fingerprint, clients get the name the owner sees
+	names := make(map[string]string)
+	for _, member := range group.Members {
+		if fingerprint, err := user.Fingerprint(member.PublicKey); err == nil {
+			names[fingerprint] = acc.memberName(fingerprint, member.Username)
+		}
+	}
+	for i, msg := range messages {
+		if name, ok := names[msg.Sender]; ok && !msg.Outgoing {
+			messages[i].Sender = name
+		}
+	}
+	json.NewEncoder(w).Encode(messages)
+}
@@ -0,0 +1,455 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sote/db"
+	"sote/user"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testMux *http.ServeMux
+
+// TestMain runs the handlers against an in-memory store. Accounts don't start tor, peer requests
+// are dialed straight to the receiving account's peer listener.
+func TestMain(m *testing.M) {
+	var err error
+	store, err = db.NewMemoryStore()
+	if err != nil {
+		log.Fatal(err)
+	}
+	peerCertificate, err = selfSignedCertificate()
+	if err != nil {
+		log.Fatal(err)
+	}
+	startOnion = func(acc *account, onionKey string) error { return nil }
+	peerTransport = &http.Transport{
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			host, _, err := net.SplitHostPort(addr)
+			if err != nil {
+				return nil, err
+			}
+			acc, err := accountByOnion(host)
+			if err != nil {
+				return nil, err
+			}
+			var d net.Dialer
+			return d.DialContext(ctx, network, acc.TorConfig.ServiceAddress())
+		},
+	}
+	testMux = newLocalMux()
+	registerPeerRoutes()
+
+	code := m.Run()
+	deactivateAllAccounts()
+	store.Close()
+	os.Exit(code)
+}
+
+// accountByOnion finds the active account that serves an onion address
+func accountByOnion(onionAddress string) (*account, error) {
+	accountsMu.Lock()
+	defer accountsMu.Unlock()
+	for _, acc := range accounts {
+		if normalizeOnion(acc.User.OnionAddress) == normalizeOnion(onionAddress) {
+			return acc, nil
+		}
+	}
+	return nil, fmt.Errorf("no account serves %s", onionAddress)
+}
+
+// call sends a request to the local endpoints and decodes the JSON answer into out
+func call(t *testing.T, token, path string, body, out interface{}) int {
+	t.Helper()
+	data, err := json.Marshal(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest(http.MethodPost, path, bytes.NewReader(data))
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	rec := httptest.NewRecorder()
+	testMux.ServeHTTP(rec, req)
+	if out != nil && rec.Code < 300 {
+		if err := json.NewDecoder(rec.Body).Decode(out); err != nil {
+			t.Fatalf("%s: %v", path, err)
+		}
+	}
+	return rec.Code
+}
+
+// registerAndLogin creates an account and returns its session token and public profile
+func registerAndLogin(t *testing.T, username, password string) (string, user.Profile) {
+	t.Helper()
+	var profile user.Profile
+	if code := call(t, "", "/register", map[string]string{"username": username, "password": password}, &profile); code != http.StatusCreated {
+		t.Fatalf("register %s: status %d", username, code)
+	}
+	t.Cleanup(func() {
+		if row, err := store.GetUser(username); err == nil {
+			os.RemoveAll(filepath.Dir(row.TorrcFilePath))
+		}
+	})
+
+	var login struct {
+		SessionToken string
+		User         user.Profile
+	}
+	if code := call(t, "", "/login", map[string]string{"username": username, "password": password}, &login); code != http.StatusOK {
+		t.Fatalf("login %s: status %d", username, code)
+	}
+	if login.SessionToken == "" || login.User.OnionAddress != profile.OnionAddress {
+		t.Fatalf("login %s returned %+v", username, login)
+	}
+	t.Cleanup(func() { deactivateAccount(username) })
+	return login.SessionToken, profile
+}
+
+// addContact saves a peer's profile as a contact and returns the nickname it got
+func addContact(t *testing.T, token string, peer user.Profile) string {
+	t.Helper()
+	if code := call(t, token, "/add-contact", peer, nil); code != http.StatusOK {
+		t.Fatalf("add-contact %s: status %d", peer.Username, code)
+	}
+	var contacts []user.Contact
+	if code := call(t, token, "/contacts", nil, &contacts); code != http.StatusOK {
+		t.Fatalf("contacts: status %d", code)
+	}
+	for _, contact := range contacts {
+		if contact.OnionAddress == normalizeOnion(peer.OnionAddress) {
+			return contact.Nickname
+		}
+	}
+	t.Fatalf("contact %s was not saved", peer.Username)
+	return ""
+}
+
+// fetchUntil fetches a conversation until it holds want messages
+func fetchUntil(t *testing.T, token, contact string, want int) []db.Message {
+	t.Helper()
+	return pollMessages(t, token, "/fetch-messages", map[string]string{"receiver": contact}, want)
+}
+
+// pollMessages calls a fetch endpoint until it returns want messages
+func pollMessages(t *testing.T, token, path string, body map[string]string, want int) []db.Message {
+	t.Helper()
+	var messages []db.Message
+	for deadline := time.Now().Add(10 * time.Second); time.Now().Before(deadline); time.Sleep(50 * time.Millisecond) {
+		messages = nil
+		if code := call(t, token, path, body, &messages); code != http.StatusOK {
+			t.Fatalf("%s %v: status %d", path, body, code)
+		}
+		if len(messages) >= want {
+			return messages
+		}
+	}
+	t.Fatalf("%s %v returned %d messages, want %d", path, body, len(messages), want)
+	return nil
+}
+
+func TestLogin(t *testing.T) {
+	token, _ := registerAndLogin(t, "carol", "correct horse")
+
+	if code := call(t, "", "/login", map[string]string{"username": "carol", "password": "wrong"}, nil); code != http.StatusUnauthorized {
+		t.Errorf("login with a wrong password: status %d, want 401", code)
+	}
+	if code := call(t, "", "/login", map[string]string{"username": "nobody", "password": "correct horse"}, nil); code != http.StatusUnauthorized {
+		t.Errorf("login of an unknown user: status %d, want 401", code)
+	}
+
+	// Logging in again while the account is active gets a second session
+	var login struct{ SessionToken string }
+	if code := call(t, "", "/login", map[string]string{"username": "carol", "password": "correct horse"}, &login); code != http.StatusOK {
+		t.Fatalf("second login: status %d", code)
+	}
+	if login.SessionToken == token {
+		t.Error("second login reused the session token")
+	}
+
+	var onion map[string]string
+	if code := call(t, token, "/get-onion-address", nil, &onion); code != http.StatusOK || onion["onionAddress"] == "" {
+		t.Errorf("get-onion-address: status %d, %v", code, onion)
+	}
+	if code := call(t, "", "/get-onion-address", nil, nil); code != http.StatusUnauthorized {
+		t.Errorf("request without a session: status %d, want 401", code)
+	}
+	if code := call(t, "not-a-session", "/contacts", nil, nil); code != http.StatusUnauthorized {
+		t.Errorf("request with an unknown session: status %d, want 401", code)
+	}
+}
+
+func TestSendReceiveFetch(t *testing.T) {
+	daveToken, dave := registerAndLogin(t, "dave", "dave's password")
+	erinToken, erin := registerAndLogin(t, "erin", "erin's password")
+	erinAtDave := addContact(t, daveToken, erin)
+	daveAtErin := addContact(t, erinToken, dave)
+
+	var sent struct {
+		ID    string
+		Seq   int
+		State string
+	}
+	if code := call(t, daveToken, "/send-message", map[string]string{"receiver": erinAtDave, "message": "hello erin"}, &sent); code != http.StatusOK {
+		t.Fatalf("send-message: status %d", code)
+	}
+	if sent.ID == "" || sent.Seq != 1 || sent.State != db.MessageQueued {
+		t.Fatalf("send-message returned %+v", sent)
+	}
+
+	// deliverOutbox posts it to erin's peer listener, erin's fetch decrypts it
+	received := fetchUntil(t, erinToken, daveAtErin, 1)
+	msg := received[0]
+	if string(msg.Message) != "hello erin" || msg.Outgoing || msg.Sender != daveAtErin || msg.UUID != sent.ID || !msg.Verified {
+		t.Errorf("erin fetched %+v", msg)
+	}
+
+	// dave sees his own copy as delivered once erin's node acknowledged it
+	var own []db.Message
+	for deadline := time.Now().Add(10 * time.Second); time.Now().Before(deadline); time.Sleep(50 * time.Millisecond) {
+		own = fetchUntil(t, daveToken, erinAtDave, 1)
+		if own[0].State == db.MessageDelivered {
+			break
+		}
+	}
+	if string(own[0].Message) != "hello erin" || !own[0].Outgoing || own[0].Receiver != erinAtDave || own[0].State != db.MessageDelivered {
+		t.Errorf("dave fetched %+v", own[0])
+	}
+
+	if code := call(t, daveToken, "/send-message", map[string]string{"receiver": "stranger", "message": "hi"}, nil); code != http.StatusNotFound {
+		t.Errorf("send-message to an unknown contact: status %d, want 404", code)
+	}
+}
+
+// Contacts choose their own usernames, two accounts called alice keep their conversation apart
+func TestSendBetweenNamesakes(t *testing.T) {
+	aliceToken, alice := registerAndLogin(t, "alice", "alice's password")
+
+	// A second node's alice, registered here under another name and introduced as alice
+	otherToken, other := registerAndLogin(t, "alice-elsewhere", "other password")
+	other.Username = "alice"
+	otherAtAlice := addContact(t, aliceToken, other)
+	if otherAtAlice == "alice" {
+		t.Fatalf("contact got the account's own name %q", otherAtAlice)
+	}
+	aliceAtOther := addContact(t, otherToken, alice)
+
+	if code := call(t, aliceToken, "/send-message", map[string]string{"receiver": otherAtAlice, "message": "from alice"}, nil); code != http.StatusOK {
+		t.Fatalf("send-message: status %d", code)
+	}
+	if code := call(t, otherToken, "/send-message", map[string]string{"receiver": aliceAtOther, "message": "from the other alice"}, nil); code != http.StatusOK {
+		t.Fatalf("send-message: status %d", code)
+	}
+
+	// Both first messages have seq 1 and both end up in the conversation
+	messages := fetchUntil(t, aliceToken, otherAtAlice, 2)
+	var outgoing, incoming int
+	for _, msg := range messages {
+		if msg.Seq != 1 {
+			t.Errorf("message %+v has seq %d, want 1", msg, msg.Seq)
+		}
+		switch {
+		case msg.Outgoing && string(msg.Message) == "from alice":
+			outgoing++
+		case !msg.Outgoing && string(msg.Message) == "from the other alice" && msg.Sender == otherAtAlice:
+			incoming++
+		default:
+			t.Errorf("unexpected message %+v", msg)
+		}
+	}
+	if outgoing != 1 || incoming != 1 {
+		t.Errorf("conversation has %d sent and %d received messages, want 1 and 1", outgoing, incoming)
+	}
+}
+
+// Group members choose their own usernames too, two members called heidi stay apart in the group
+func TestGroupMessagesFromNamesakes(t *testing.T) {
+	graceToken, grace := registerAndLogin(t, "grace", "grace's password")
+	heidiToken, heidi := registerAndLogin(t, "heidi", "heidi's password")
+	otherToken, other := registerAndLogin(t, "heidi-elsewhere", "other password")
+	other.Username = "heidi"
+	heidiAtGrace := addContact(t, graceToken, heidi)
+	otherAtGrace := addContact(t, graceToken, other)
+	// Member lists are only accepted from contacts
+	addContact(t, heidiToken, grace)
+	addContact(t, otherToken, grace)
+
+	var group db.Group
+	if code := call(t, graceToken, "/create-group", map[string]string{"name": "heidis"}, &group); code != http.StatusOK {
+		t.Fatalf("create-group: status %d", code)
+	}
+	for _, contact := range []string{heidiAtGrace, otherAtGrace} {
+		if code := call(t, graceToken, "/invite-to-group", map[string]string{"group": group.GroupID, "contact": contact}, nil); code != http.StatusOK {
+			t.Fatalf("invite-to-group %s: status %d", contact, code)
+		}
+	}
+	for _, token := range []string{heidiToken, otherToken} {
+		waitForMembers(t, token, group.GroupID, 3)
+	}
+
+	for _, sender := range []struct{ token, message string }{{heidiToken, "from heidi"}, {otherToken, "from the other heidi"}} {
+		if code := call(t, sender.token, "/send-group-message", map[string]string{"group": group.GroupID, "message": sender.message}, nil); code != http.StatusOK {
+			t.Fatalf("send-group-message: status %d", code)
+		}
+	}
+
+	// grace knows both as contacts and sees their nicknames, both first messages have seq 1
+	senders := map[string]string{}
+	for _, msg := range pollMessages(t, graceToken, "/fetch-group-messages", map[string]string{"group": group.GroupID}, 2) {
+		if msg.Seq != 1 || msg.Outgoing {
+			t.Errorf("grace fetched %+v", msg)
+		}
+		senders[string(msg.Message)] = msg.Sender
+	}
+	if senders["from heidi"] != heidiAtGrace || senders["from the other heidi"] != otherAtGrace {
+		t.Errorf("grace sees the messages from %v, want %s and %s", senders, heidiAtGrace, otherAtGrace)
+	}
+
+	// heidi doesn't know the other heidi, who chose heidi's own name
+	var own, received int
+	for _, msg := range pollMessages(t, heidiToken, "/fetch-group-messages", map[string]string{"group": group.GroupID}, 2) {
+		switch {
+		case msg.Outgoing && string(msg.Message) == "from heidi":
+			own++
+		case !msg.Outgoing && string(msg.Message) == "from the other heidi" && msg.Sender != "heidi" && strings.HasPrefix(msg.Sender, "heidi ("):
+			received++
+		default:
+			t.Errorf("heidi fetched %+v", msg)
+		}
+	}
+	if own != 1 || received != 1 {
+		t.Errorf("heidi has %d own and %d received group messages, want 1 and 1", own, received)
+	}
+}
+
+// waitForMembers waits until the creator's member list with want members reached an account
+func waitForMembers(t *testing.T, token, groupID string, want int) {
+	t.Helper()
+	for deadline := time.Now().Add(10 * time.Second); time.Now().Before(deadline); time.Sleep(50 * time.Millisecond) {
+		var groups []db.Group
+		if code := call(t, token, "/groups", nil, &groups); code != http.StatusOK {
+			t.Fatalf("groups: status %d", code)
+		}
+		for _, group := range groups {
+			if group.GroupID == groupID && len(group.Members) == want {
+				return
+			}
+		}
+	}
+	t.Fatalf("group %s didn't reach %d members", groupID, want)
+}
+
+// The client manages bridges through the node instead of opening its database
+func TestBridges(t *testing.T) {
+	token, _ := registerAndLogin(t, "ivan", "ivan's password")
+	line := "obfs4 192.0.2.1:443 0123456789ABCDEF0123456789ABCDEF01234567 cert=abc iat-mode=0"
+
+	if code := call(t, "", "/add-bridges", map[string]string{"bridges": line}, nil); code != http.StatusUnauthorized {
+		t.Errorf("add-bridges without a session: status %d, want 401", code)
+	}
+	var added struct{ Added []string }
+	if code := call(t, token, "/add-bridges", map[string]string{"bridges": line}, &added); code != http.StatusOK || len(added.Added) != 1 {
+		t.Fatalf("add-bridges: status %d, %+v", code, added)
+	}
+	if code := call(t, token, "/add-bridges", map[string]string{"bridges": "not a bridge"}, nil); code != http.StatusBadRequest {
+		t.Errorf("add-bridges with an invalid line: status %d, want 400", code)
+	}
+
+	var list struct{ Bridges []db.Bridge }
+	if code := call(t, token, "/bridges", nil, &list); code != http.StatusOK || len(list.Bridges) != 1 || list.Bridges[0].Line != line {
+		t.Fatalf("bridges: status %d, %+v", code, list)
+	}
+	id := fmt.Sprint(list.Bridges[0].ID)
+	if code := call(t, token, "/remove-bridge", map[string]string{"id": id}, nil); code != http.StatusOK {
+		t.Errorf("remove-bridge: status %d", code)
+	}
+	if code := call(t, token, "/remove-bridge", map[string]string{"id": id}, nil); code != http.StatusNotFound {
+		t.Errorf("removing a removed bridge: status %d, want 404", code)
+	}
+
+	if code := call(t, token, "/transport-plugin", map[string]string{"path": "/nonexistent/lyrebird"}, nil); code != http.StatusBadRequest {
+		t.Errorf("transport-plugin with a missing file: status %d, want 400", code)
+	}
+}
+
+// Logins that race on an account from before Argon2id migrate its keys once
+func TestConcurrentLegacyLogins(t *testing.T) {
+	const password = "judy's password"
+	var profile user.Profile
+	if code := call(t, "", "/register", map[string]string{"username": "judy", "password": password}, &profile); code != http.StatusCreated {
+		t.Fatalf("register: status %d", code)
+	}
+	row, err := store.GetUser("judy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		deactivateAccount("judy")
+		os.RemoveAll(filepath.Dir(row.TorrcFilePath))
+	})
+
+	// Turn the account into one from before Argon2id, its secrets encrypted with the SHA-256 key
+	params, err := user.ParseKDFParams(row.KDFParams)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encryptionKey := user.DeriveKey(password, params)
+	legacyKey := user.LegacyKey(password)
+	reencrypt := func(data []byte) []byte {
+		plain, err := user.DecryptAES256(data, encryptionKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		encrypted, err := user.EncryptAES256(plain, legacyKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return encrypted
+	}
+	legacyHash := []byte(password)
+	for i := 0; i < 21; i++ {
+		hash := sha256.Sum256(legacyHash)
+		legacyHash = hash[:]
+	}
+	err = store.(db.LegacyMigrator).UpdateUserKeys("judy", fmt.Sprintf("%x", legacyHash), "", reencrypt(row.PrivateKey), reencrypt(row.OnionPrivateKey), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	codes := make(chan int, 4)
+	for i := 0; i < cap(codes); i++ {
+		go func() {
+			codes <- call(t, "", "/login", map[string]string{"username": "judy", "password": password}, nil)
+		}()
+	}
+	for i := 0; i < cap(codes); i++ {
+		if code := <-codes; code != http.StatusOK {
+			t.Errorf("concurrent login: status %d", code)
+		}
+	}
+
+	// The keys the first login stored still open the account's data
+	if err := deactivateAccount("judy"); err != nil {
+		t.Log("Stopping tor:", err)
+	}
+	var login struct{ SessionToken string }
+	if code := call(t, "", "/login", map[string]string{"username": "judy", "password": password}, &login); code != http.StatusOK {
+		t.Fatalf("login after the migration: status %d", code)
+	}
+	if code := call(t, login.SessionToken, "/contacts", nil, nil); code != http.StatusOK {
+		t.Errorf("contacts after the migration: status %d", code)
+	}
+}
@@ -1,78 +1,159 @@
 package main
 
 import (
-	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
 	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"encoding/json"
-	"errors"
 	"fmt"
 	"log"
+	"math/big"
+	"net"
 	"net/http"
-	"net/url"
 	"os"
-	"os/exec"
+	"os/signal"
 	"sote/db"
-	"sote/tor"
 	"sote/user"
 	"strings"
-	"sync"
+	"syscall"
 	"time"
 )
 
-var currentUser *user.User
-var mu sync.Mutex
-var port string = "18080"
+// socketPath serves the client, peerMux is served on every account's onion service
+var socketPath string = "sote.sock"
+var peerMux = http.NewServeMux()
+var peerCertificate tls.Certificate
+
+// store holds the accounts and their data, handlers use it instead of opening the database themselves
+var store db.Store
 
 func main() {
-	s, _ := os.Stat("server.key")
-	if s == nil {
-		fmt.Println("SSL Certificates not found. Creating...")
-		cmd := exec.Command("openssl", "genrsa", "-out", "server.key", "2048")
-		cmd.Run()
-		cmd = exec.Command("openssl", "req", "-new", "-x509", "-key", "server.key", "-out", "server.crt", "-days", "3650", "-subj", "/C=US/ST=State/L=City/O=Organization/OU=Department/CN=localhost")
-		cmd.Run()
-	}
-	keyFile := "./server.key"
-	certFile := "./server.crt"
+	if p := os.Getenv("SOTE_SOCKET"); p != "" {
+		socketPath = p
+	}
+	var err error
+	peerCertificate, err = selfSignedCertificate()
+	if err != nil {
+		log.Fatal("Error creating TLS certificate:", err)
+	}
 	// Initialize database
-	db.Initialize()
-
-	http.HandleFunc("/register", registerHandler)
-	http.HandleFunc("/login", loginHandler)
-	http.HandleFunc("/get-onion-address", getOnionAddressHandler)
-	http.HandleFunc("/add-contact", addContactHandler)
-	http.HandleFunc("/receive-contact-request", receiveContactRequestHandler)
-	http.HandleFunc("/set-current-user", setCurrentUserHandler)
-	http.HandleFunc("/send-message", sendMessageHandler)
-	http.HandleFunc("/fetch-messages", fetchMessagesHandler)
-	http.HandleFunc("/receive-message", receiveMessageHandler)
-
-	fmt.Printf("Node is running on port %s\n", port)
-	log.Fatal(http.ListenAndServeTLS(":"+port, certFile, keyFile, nil))
+	store, err = db.NewSQLiteStore("./localDB.db")
+	if err != nil {
+		log.Fatal("Error opening database:", err)
+	}
+
+	localMux := newLocalMux()
+	registerPeerRoutes()
+
+	listener, err := listenUnix(socketPath)
+	if err != nil {
+		log.Fatal("Error creating unix socket:", err)
+	}
+	// Shut every account's tor down when the node exits
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+		fmt.Println("Shutting down node...")
+		listener.Close()
+		deactivateAllAccounts()
+		store.Close()
+		os.Exit(0)
+	}()
+
+	fmt.Printf("Node is running on %s\n", socketPath)
+	log.Fatal(http.Serve(listener, localMux))
 }
 
-func setCurrentUserHandler(w http.ResponseWriter, r *http.Request) {
-	var req user.User
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
-		return
+// listenUnix listens on a unix socket that only the current user can access
+func listenUnix(path string) (net.Listener, error) {
+	// Remove the socket left behind by a previous run
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return nil, err
 	}
 
-	mu.Lock()
-	currentUser = &req
-	mu.Unlock()
-
-	fmt.Println("Current user set to:", currentUser.Username) // Debug print
-	w.WriteHeader(http.StatusOK)
+	oldMask := syscall.Umask(0177)
+	listener, err := net.Listen("unix", path)
+	syscall.Umask(oldMask)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, 0600); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return listener, nil
 }
 
-func getCurrentUser() (*user.User, error) {
-	mu.Lock()
-	defer mu.Unlock()
-	if currentUser == nil {
-		return nil, errors.New("no user is currently logged in")
+// selfSignedCertificate creates the in-memory certificate the peer listener uses.
+// Peers reach us through the onion service, which already authenticates the address.
+func selfSignedCertificate() (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return tls.Certificate{}, err
 	}
-	return currentUser, nil
+	template := x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: "sote"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().AddDate(10, 0, 0),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
+
+// newLocalMux returns the local endpoints. They are only served on the unix socket so only the client reaches them.
+func newLocalMux() *http.ServeMux {
+	localMux := http.NewServeMux()
+	localMux.HandleFunc("/register", registerHandler)
+	localMux.HandleFunc("/login", loginHandler)
+	localMux.HandleFunc("/logout", requireSession(logoutHandler))
+	localMux.HandleFunc("/get-onion-address", requireSession(getOnionAddressHandler))
+	localMux.HandleFunc("/contacts", requireSession(listContactsHandler))
+	localMux.HandleFunc("/add-contact", requireSession(addContactHandler))
+	localMux.HandleFunc("/rename-contact", requireSession(renameContactHandler))
+	localMux.HandleFunc("/send-contact-request", requireSession(sendContactRequestHandler))
+	localMux.HandleFunc("/contact-requests", requireSession(listContactRequestsHandler))
+	localMux.HandleFunc("/answer-contact-request", requireSession(answerContactRequestHandler))
+	localMux.HandleFunc("/send-message", requireSession(sendMessageHandler))
+	localMux.HandleFunc("/fetch-messages", requireSession(fetchMessagesHandler))
+	localMux.HandleFunc("/receipt-settings", requireSession(receiptSettingsHandler))
+	localMux.HandleFunc("/mark-read", requireSession(markReadHandler))
+	localMux.HandleFunc("/events", requireSession(eventsHandler))
+	localMux.HandleFunc("/create-group", requireSession(createGroupHandler))
+	localMux.HandleFunc("/groups", requireSession(listGroupsHandler))
+	localMux.HandleFunc("/invite-to-group", requireSession(inviteToGroupHandler))
+	localMux.HandleFunc("/remove-from-group", requireSession(removeFromGroupHandler))
+	localMux.HandleFunc("/send-group-message", requireSession(sendGroupMessageHandler))
+	localMux.HandleFunc("/fetch-group-messages", requireSession(fetchGroupMessagesHandler))
+	localMux.HandleFunc("/bridges", requireSession(listBridgesHandler))
+	localMux.HandleFunc("/add-bridges", requireSession(addBridgesHandler))
+	localMux.HandleFunc("/remove-bridge", requireSession(removeBridgeHandler))
+	localMux.HandleFunc("/transport-plugin", requireSession(transportPluginHandler))
+	return localMux
+}
+
+// registerPeerRoutes adds the remote endpoints, reached by peers through each account's onion service.
+// Every peer request is signed, see peerauth.go.
+func registerPeerRoutes() {
+	peerMux.HandleFunc("/receive-contact-request", peerOnly(receiveContactRequestHandler))
+	peerMux.HandleFunc("/receive-contact-accept", peerOnly(receiveContactAcceptHandler))
+	peerMux.HandleFunc("/receive-message", requireContact(receiveMessageHandler))
+	peerMux.HandleFunc("/receive-receipt", requireContact(receiveReceiptHandler))
+	peerMux.HandleFunc("/receive-group-update", requireContact(receiveGroupUpdateHandler))
+	peerMux.HandleFunc("/receive-group-message", peerOnly(receiveGroupMessageHandler))
 }
 
 func registerHandler(w http.ResponseWriter, r *http.Request) {
@@ -96,7 +177,16 @@ func registerHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	fmt.Println("User created successfully:", newUser.Username) // Debug print
 
-	err = db.SaveUser(newUser.Username, newUser.Password, newUser.PrivateKey, newUser.PublicKey, newUser.OnionAddress, newUser.TorrcFilePath)
+	newUser.ID, err = store.SaveUser(db.UserRow{
+		Username:        newUser.Username,
+		Password:        newUser.Password,
+		PrivateKey:      newUser.PrivateKey,
+		PublicKey:       newUser.PublicKey,
+		OnionAddress:    newUser.OnionAddress,
+		TorrcFilePath:   newUser.TorrcFilePath,
+		OnionPrivateKey: newUser.OnionPrivateKey,
+		KDFParams:       newUser.KDFParams,
+	})
 	if err != nil {
 		fmt.Println("Error saving user:", err) // Debug print
 		http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -104,8 +194,9 @@ func registerHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	fmt.Println("User saved successfully in the database") // Debug print
 
+	// Only the public profile goes back to the client, secrets stay in the node
 	w.WriteHeader(http.StatusCreated)
-	json.NewEncoder(w).Encode(newUser)
+	json.NewEncoder(w).Encode(newUser.Profile)
 	fmt.Println("User has registered successfully!") // Debug print
 }
 
@@ -121,64 +212,161 @@ func loginHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Retrieve user data from the database
-	uUsername, uPassword, uPrivateKey, uPublicKey, uOnionAddress, uTorrcFilePath, err := db.GetUser(req.Username)
+	row, err := store.GetUser(req.Username)
 	if err != nil {
 		http.Error(w, "Invalid username or password", http.StatusUnauthorized)
 		return
 	}
 
-	// Hash the provided password
-	hashedPassword := user.HashPassword(req.Password)
+	// Logins of one account run one at a time, unlocking may migrate its keys.
+	// The row is read again, a login that held the lock may have changed it.
+	defer lockLogin(row.Username)()
+	row, err = store.GetUser(row.Username)
+	if err != nil {
+		http.Error(w, "Invalid username or password", http.StatusUnauthorized)
+		return
+	}
 
-	// Compare the hashed password with the stored hashed password
-	if hashedPassword != uPassword {
+	// Check the provided password against the stored hash
+	if !user.VerifyPassword(req.Password, row.Password) {
 		http.Error(w, "Invalid username or password", http.StatusUnauthorized)
 		return
 	}
 
-	currentUser := &user.User{
-		Username:      uUsername,
-		Password:      uPassword,
-		PrivateKey:    uPrivateKey,
-		PublicKey:     uPublicKey,
-		OnionAddress:  uOnionAddress,
-		TorrcFilePath: uTorrcFilePath,
-		RawPassword:   req.Password,
+	// An account that is already active keeps its unlocked keys, only the password is checked
+	acc, err := getAccount(row.Username)
+	if err != nil {
+		var ok bool
+		if acc, ok = unlockAndActivate(w, row, req.Password); !ok {
+			return
+		}
 	}
 
-	// Start Tor hidden service using the torrc file path
-	err = tor.StartTorWithConfig(uTorrcFilePath)
+	// Issue a session token that the client sends with every local request
+	token, err := newSession(row.Username)
 	if err != nil {
-		http.Error(w, "Failed to start Tor hidden service", http.StatusInternalServerError)
+		http.Error(w, "Failed to create session", http.StatusInternalServerError)
 		return
 	}
-	json.NewEncoder(w).Encode(currentUser)
+	// The client only gets the session handle and the public profile
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"sessionToken": token,
+		"user":         acc.User.Profile,
+	})
+}
+
+// unlockAndActivate unlocks the keys of an account that isn't active and starts its tor,
+// it writes the error response otherwise. The caller holds the account's login lock.
+func unlockAndActivate(w http.ResponseWriter, row db.UserRow, password string) (*account, bool) {
+	loggedInUser := &user.User{
+		ID: row.ID,
+		Profile: user.Profile{
+			Username:     row.Username,
+			OnionAddress: row.OnionAddress,
+			PublicKey:    row.PublicKey,
+		},
+		Secrets: user.Secrets{
+			Password:      row.Password,
+			PrivateKey:    row.PrivateKey,
+			TorrcFilePath: row.TorrcFilePath,
+		},
+	}
+
+	// Derive the key of the account's secrets, older accounts are migrated here
+	err := unlockUser(loggedInUser, password)
+	if err != nil {
+		fmt.Println("Error unlocking user:", err) // Debug print
+		http.Error(w, "Failed to unlock account", http.StatusInternalServerError)
+		return nil, false
+	}
+
+	onionKey, err := loadOnionKey(loggedInUser)
+	if err != nil {
+		fmt.Println("Error loading onion key:", err) // Debug print
+		http.Error(w, "Failed to load onion key", http.StatusInternalServerError)
+		return nil, false
+	}
+
+	// Register the account and start its Tor hidden service
+	acc, err := activateAccount(loggedInUser, onionKey)
+	if err != nil {
+		fmt.Println("Error activating account:", err) // Debug print
+		http.Error(w, "Failed to start Tor hidden service", http.StatusInternalServerError)
+		return nil, false
+	}
+	// An account that is already active keeps its own unlocked keys
+	if acc.User != loggedInUser {
+		loggedInUser.Lock()
+	}
+	return acc, true
+}
+
+// logoutHandler ends the session and stops the account's tor once its last session is gone
+func logoutHandler(w http.ResponseWriter, r *http.Request) {
+	username, stillLoggedIn := deleteSession(r)
+	if !stillLoggedIn {
+		if err := deactivateAccount(username); err != nil {
+			fmt.Println("Error stopping tor:", err) // Debug print
+		}
+	}
+	fmt.Println("User logged out:", username) // Debug print
+	w.WriteHeader(http.StatusOK)
 }
 
 func getOnionAddressHandler(w http.ResponseWriter, r *http.Request) {
-	var req struct {
-		Username string `json:"username"`
-		Password string `json:"password"`
+	acc, err := accountFromSession(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
 	}
 
+	json.NewEncoder(w).Encode(map[string]string{
+		"onionAddress": acc.User.OnionAddress,
+	})
+}
+
+// listContactsHandler returns the contacts of the logged-in account
+func listContactsHandler(w http.ResponseWriter, r *http.Request) {
+	acc, err := accountFromSession(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	contacts, err := store.GetContacts(acc.User.ID)
+	if err != nil {
+		http.Error(w, "Failed to fetch contacts", http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(contacts)
+}
+
+// renameContactHandler changes the nickname of a contact, given by nickname or fingerprint
+func renameContactHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Contact  string `json:"contact"`
+		Nickname string `json:"nickname"`
+	}
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	_, _, _, _, uOnionAddress, _, err := db.GetUser(req.Username)
+	acc, err := accountFromSession(r)
 	if err != nil {
-		http.Error(w, "Invalid username or password", http.StatusUnauthorized)
+		http.Error(w, err.Error(), http.StatusUnauthorized)
 		return
 	}
-
-	currentUser := &user.User{
-		OnionAddress: uOnionAddress,
+	contact, err := store.GetContact(acc.User.ID, req.Contact)
+	if err != nil {
+		http.Error(w, "Contact not found", http.StatusNotFound)
+		return
 	}
-
-	json.NewEncoder(w).Encode(map[string]string{
-		"onionAddress": currentUser.OnionAddress,
-	})
+	if err := store.RenameContact(acc.User.ID, contact.ID, req.Nickname); err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	contact.Nickname = strings.TrimSpace(req.Nickname)
+	json.NewEncoder(w).Encode(contact)
 }
 
 func addContactHandler(w http.ResponseWriter, r *http.Request) {
@@ -192,8 +380,14 @@ func addContactHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	acc, err := accountFromSession(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
 	// Save contact to database
-	err := db.SaveContact(currentUser.Username, req.Username, req.OnionAddress, req.PublicKey)
+	_, err = store.SaveContact(acc.User.ID, req.Username, normalizeOnion(req.OnionAddress), req.PublicKey)
 	fmt.Println("Attempting to save contact to database...")
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -204,96 +398,167 @@ func addContactHandler(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusOK)
 }
 
-func receiveContactRequestHandler(w http.ResponseWriter, r *http.Request) {
+// sendContactRequestHandler sends the account's contact data to a peer's onion service
+func sendContactRequestHandler(w http.ResponseWriter, r *http.Request) {
 	var req struct {
-		Username     string `json:"username"`
 		OnionAddress string `json:"onionAddress"`
-		PublicKey    []byte `json:"publicKey"`
 	}
-
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	fmt.Printf("[%v]Incoming contact request from Username: %s, onionAdress:(%s)\n", time.Now(), req.Username, req.OnionAddress)
-	fmt.Printf("Do you accept this contact request? (y/n): ")
+	acc, err := accountFromSession(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
 
-	var response string
-	fmt.Scanln(&response)
+	jsonData, err := json.Marshal(map[string]interface{}{
+		"username":     acc.User.Username,
+		"onionAddress": acc.User.OnionAddress,
+		"publicKey":    acc.User.PublicKey,
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
 
-	if response == "y" {
-		// Get own contact information
-		currentUser, err := getCurrentUser()
-		if err != nil {
-			fmt.Println("Error getting current user:", err) // Debug print
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
+	// Remember the request, only peers we asked may send their contact data back
+	onionAddress := normalizeOnion(req.OnionAddress)
+	err = store.SaveContactRequest(acc.User.ID, onionAddress, db.OutgoingContactRequest, "", nil)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
 
-		// Check if the contact being added is not the current user
-		if req.Username != currentUser.Username && req.OnionAddress != currentUser.OnionAddress {
-			// Save contact to database
-			err := db.SaveContact(currentUser.Username, req.Username, req.OnionAddress, req.PublicKey)
-			if err != nil {
-				fmt.Println("Error saving contact:", err) // Debug print
-				http.Error(w, err.Error(), http.StatusInternalServerError)
-				return
-			}
-		} else {
-			fmt.Println("Attempted to add self as contact, skipping...")
-		}
+	fmt.Println("Sending contact request to:", onionAddress) // Debug print
+	resp, err := acc.postToPeer(onionAddress, "/receive-contact-request", jsonData)
+	if err != nil {
+		fmt.Println("Failed to send contact request:", err) // Debug print
+		http.Error(w, "Failed to send contact request", http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
 
-		// Clean the .onion address
-		cleanedOnionAddress := strings.TrimSpace(req.OnionAddress)
+	// The peer answers later, 202 only means the request is waiting for them
+	if resp.StatusCode != http.StatusAccepted {
+		http.Error(w, fmt.Sprintf("Contact request was not accepted: %s", resp.Status), http.StatusBadGateway)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
 
-		// Send own contact information back to the requester
-		ownContactData := map[string]interface{}{
-			"username":     currentUser.Username,
-			"onionAddress": currentUser.OnionAddress,
-			"publicKey":    currentUser.PublicKey,
-		}
-		jsonData, err := json.Marshal(ownContactData)
-		if err != nil {
-			fmt.Println("Error marshalling own contact data:", err) // Debug print
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
+// receiveContactAcceptHandler saves the contact data a peer sends back after accepting our request
+func receiveContactAcceptHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Username     string `json:"username"`
+		OnionAddress string `json:"onionAddress"`
+		PublicKey    []byte `json:"publicKey"`
+	}
+	onionAddress, body, err := readPeerRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	if err := json.Unmarshal(body, &req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
-		// Configure Tor proxy
-		proxyURL, err := url.Parse("socks5://127.0.0.1:9060")
-		if err != nil {
-			fmt.Println("Error parsing proxy URL:", err) // Debug print
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
+	acc, err := accountFromPeer(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
 
-		// Create HTTP client with Tor proxy
-		client := &http.Client{
-			Transport: &http.Transport{
-				TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
-				Proxy:           http.ProxyURL(proxyURL),
-			},
-		}
+	// Contact data is only accepted from peers we sent a request to
+	requested, err := store.HasContactRequest(acc.User.ID, onionAddress, db.OutgoingContactRequest)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !requested {
+		fmt.Println("Rejected unsolicited contact data from:", onionAddress) // Debug print
+		http.Error(w, "No contact request was sent to this address", http.StatusForbidden)
+		return
+	}
+	if err := verifySelfSignedPeer(r, acc, onionAddress, body, req.OnionAddress, req.PublicKey); err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
 
-		resp, err := client.Post(fmt.Sprintf("https://%s:18080/add-contact", cleanedOnionAddress), "application/json", bytes.NewBuffer(jsonData))
-		if err != nil {
-			fmt.Println("Error sending own contact data:", err) // Debug print
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
-		defer resp.Body.Close()
+	contact, err := store.SaveContact(acc.User.ID, req.Username, onionAddress, req.PublicKey)
+	if err != nil {
+		fmt.Println("Error saving contact:", err) // Debug print
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	err = store.DeleteContactRequest(acc.User.ID, onionAddress, db.OutgoingContactRequest)
+	if err != nil {
+		fmt.Println("Error removing contact request:", err) // Debug print
+	}
+	fmt.Println("Contact accepted our request:", req.Username)
+	acc.publish(contactEvent, map[string]string{
+		"username":     contact.Username,
+		"nickname":     contact.Nickname,
+		"fingerprint":  contact.Fingerprint,
+		"onionAddress": onionAddress,
+	})
+	w.WriteHeader(http.StatusOK)
+}
 
-		if resp.StatusCode != http.StatusOK {
-			fmt.Println("Failed to send own contact data:", resp.Status) // Debug print
-			http.Error(w, "Failed to send own contact data", http.StatusInternalServerError)
-			return
-		}
+// receiveContactRequestHandler stores a peer's contact request as pending and answers 202 right away
+func receiveContactRequestHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Username     string `json:"username"`
+		OnionAddress string `json:"onionAddress"`
+		PublicKey    []byte `json:"publicKey"`
+	}
 
-		w.WriteHeader(http.StatusOK)
-	} else {
-		w.WriteHeader(http.StatusForbidden)
+	onionAddress, body, err := readPeerRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	if err := json.Unmarshal(body, &req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	acc, err := accountFromPeer(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	currentUser := acc.User
+
+	// The requester proves it holds the key it wants to be added with
+	if err := verifySelfSignedPeer(r, acc, onionAddress, body, req.OnionAddress, req.PublicKey); err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	// Check if the contact being added is not the current user
+	if onionAddress == normalizeOnion(currentUser.OnionAddress) {
+		fmt.Println("Attempted to add self as contact, skipping...")
+		http.Error(w, "Can't add yourself as a contact", http.StatusBadRequest)
+		return
+	}
+
+	// Store the request, the user answers it from the client later
+	err = store.SaveContactRequest(currentUser.ID, onionAddress, db.IncomingContactRequest, req.Username, req.PublicKey)
+	if err != nil {
+		fmt.Println("Error saving contact request:", err) // Debug print
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
 	}
+	fmt.Printf("[%v]Incoming contact request for %s from Username: %s, onionAdress:(%s)\n", time.Now(), currentUser.Username, req.Username, onionAddress)
+	acc.publish(contactRequestEvent, map[string]string{
+		"username":     req.Username,
+		"onionAddress": onionAddress,
+	})
+	w.WriteHeader(http.StatusAccepted)
 }
 
 func sendMessageHandler(w http.ResponseWriter, r *http.Request) {
@@ -307,101 +572,143 @@ func sendMessageHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Encrypt the message
-	receiver, err := db.GetContactByUsername(req.Receiver)
+	acc, err := accountFromSession(r)
 	if err != nil {
-		http.Error(w, "Receiver not found", http.StatusNotFound)
+		http.Error(w, err.Error(), http.StatusUnauthorized)
 		return
 	}
-	encryptedMessage, err := user.EncryptMessage([]byte(req.Message), receiver.PublicKey)
+	currentUser := acc.User
+	req.Sender = currentUser.Username
+
+	// The receiver is the contact's nickname or fingerprint, not the name they chose
+	receiver, err := store.GetContact(currentUser.ID, req.Receiver)
 	if err != nil {
-		http.Error(w, "Failed to encrypt message", http.StatusInternalServerError)
+		http.Error(w, "Receiver not found", http.StatusNotFound)
 		return
 	}
-
-	// Configure Tor proxy
-	proxyURL, err := url.Parse("socks5://127.0.0.1:9060")
+	encryptedMessage, err := user.EncryptMessage([]byte(req.Message), receiver.PublicKey, currentUser.KeyRing)
 	if err != nil {
-		http.Error(w, "Failed to parse proxy URL", http.StatusInternalServerError)
+		http.Error(w, "Failed to encrypt message", http.StatusInternalServerError)
 		return
 	}
 
-	// Create HTTP client with Tor proxy
-	client := &http.Client{
-		Transport: &http.Transport{
-			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
-			Proxy:           http.ProxyURL(proxyURL),
-		},
-	}
 	// encrypt sended message symmetrically
-	ownEncryptedMessage, err := user.EncryptAES256([]byte(req.Message), currentUser.RawPassword)
+	ownEncryptedMessage, err := user.EncryptAES256([]byte(req.Message), currentUser.EncryptionKey)
 	if err != nil {
 		fmt.Println("Failed to enncrypted sended message: ", err)
+		http.Error(w, "Failed to encrypt message", http.StatusInternalServerError)
 		return
 	}
-	req.Message = string(encryptedMessage)
 
-	// Marshal the updated request struct to JSON
-	jsonData, err := json.Marshal(req)
+	// The receiver uses the ID to ignore redelivered copies
+	messageID, err := newMessageID()
 	if err != nil {
-		http.Error(w, "Failed to marshal JSON", http.StatusInternalServerError)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	// Clean the receiver's .onion address
-	cleanedOnionAddress := strings.TrimSpace(receiver.OnionAddress)
-
-	// Send the message to the receiver's .onion address
-	url := fmt.Sprintf("https://%s:18080/receive-message", cleanedOnionAddress)
-	resp, err := client.Post(url, "application/json", bytes.NewBuffer(jsonData))
+	// Queue the message, deliverOutbox sends it through tor and retries while the receiver is offline
+	sentAt := time.Now()
+	seq, err := store.QueueMessage(currentUser.ID, receiver, req.Sender, ownEncryptedMessage, encryptedMessage, messageID, sentAt, sentAt.Add(outboxMaxAge))
 	if err != nil {
-		fmt.Printf("Failed to send message to receiver: %v\n", err)
-		http.Error(w, "Failed to send message to receiver", http.StatusInternalServerError)
+		http.Error(w, "Failed to save message", http.StatusInternalServerError)
 		return
 	}
-	defer resp.Body.Close()
+	acc.wakeOutbox()
+	fmt.Println("Message queued for:", receiver.Nickname) // Debug print
 
-	fmt.Println("Message posted succesfully")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"id":    messageID,
+		"seq":   seq,
+		"state": db.MessageQueued,
+	})
+}
 
-	if resp.StatusCode != http.StatusOK {
-		fmt.Printf("Failed to send message: %s\n", resp.Status)
-		http.Error(w, fmt.Sprintf("Failed to send message: %s", resp.Status), http.StatusInternalServerError)
+func receiveMessageHandler(w http.ResponseWriter, r *http.Request) {
+	var req peerMessage
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.ID == "" || len(req.ID) > 64 || req.Seq < 1 {
+		http.Error(w, "Message has no valid id or sequence number", http.StatusBadRequest)
 		return
 	}
 
-	// Save the message to the database
-	err = db.SaveMessage(req.Sender, req.Receiver, ownEncryptedMessage)
+	// Route the message to the account it was sent to
+	acc, err := accountFromPeer(r)
 	if err != nil {
-		http.Error(w, "Failed to save message", http.StatusInternalServerError)
+		http.Error(w, err.Error(), http.StatusNotFound)
 		return
 	}
+	req.Receiver = acc.User.Username
 
-	w.WriteHeader(http.StatusOK)
-}
-
-func receiveMessageHandler(w http.ResponseWriter, r *http.Request) {
-	var req struct {
-		Sender   string `json:"sender"`
-		Receiver string `json:"receiver"`
-		Message  string `json:"message"`
+	// The sender is the contact that signed the request, not the name in the body
+	sender, err := contactFromPeer(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
 	}
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+	// Contacts are stored by their key, the username they chose may be anyone's
+	req.Sender = sender.Fingerprint
+
+	// Only accept messages signed by that contact
+	plain, err := user.DecryptMessage([]byte(req.Message), acc.User.KeyRing, sender.PublicKey)
+	if err != nil {
+		fmt.Println("Rejected message with invalid signature from:", sender.Nickname) // Debug print
+		http.Error(w, "Message signature could not be verified", http.StatusUnprocessableEntity)
 		return
 	}
 
-	// Save the encrypted message to the database
-	err := db.SaveMessage(req.Sender, req.Receiver, []byte(req.Message))
+	// Save the encrypted message to the database, a redelivered message is acknowledged again
+	inserted, err := store.SaveMessage(acc.User.ID, sender.ID, req.Sender, req.Receiver, []byte(req.Message), true, req.ID, req.SentAt, req.Seq)
 	if err != nil {
 		http.Error(w, "Failed to save message", http.StatusInternalServerError)
 		return
 	}
-	// Print a notification that a message has been received
-	fmt.Printf("New message received from %s\n", req.Sender)
+	if inserted {
+		// Print a notification that a message has been received
+		fmt.Printf("New message received for %s from %s\n", req.Receiver, sender.Nickname)
+		acc.publish(messageEvent, map[string]interface{}{
+			"id":          req.ID,
+			"sender":      sender.Nickname,
+			"fingerprint": sender.Fingerprint,
+			"receiver":    req.Receiver,
+			"message":     plain,
+			"sentAt":      req.SentAt,
+			"seq":         req.Seq,
+		})
+
+		if err := acc.sendReceiptIfEnabled(sender, db.DeliveredReceipt, []string{req.ID}); err != nil {
+			fmt.Println("Error queueing delivery receipt:", err) // Debug print
+		}
+	}
 
 	w.WriteHeader(http.StatusOK)
 }
 
+// decryptMessages replaces stored messages with their plaintext. The account's own messages are its
+// AES copies, received ones are PGP messages whose signature was verified when they arrived.
+func (acc *account) decryptMessages(messages []db.Message) error {
+	var err error
+	for i, msg := range messages {
+		var plain []byte
+		if msg.Outgoing {
+			plain, err = user.DecryptAES256(msg.Message, acc.User.EncryptionKey)
+		} else {
+			var decrypted string
+			decrypted, err = user.DecryptMessage(msg.Message, acc.User.KeyRing, nil)
+			plain = []byte(decrypted)
+		}
+		if err != nil {
+			fmt.Println("Failed to decrypt message:", msg.ID, err) // Debug print
+			return err
+		}
+		messages[i].Message = plain
+	}
+	return nil
+}
+
 func fetchMessagesHandler(w http.ResponseWriter, r *http.Request) {
 	var req struct {
 		Sender   string `json:"sender"`
@@ -412,8 +719,21 @@ func fetchMessagesHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	acc, err := accountFromSession(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	req.Sender = acc.User.Username
+
+	contact, err := store.GetContact(acc.User.ID, req.Receiver)
+	if err != nil {
+		http.Error(w, "Contact not found", http.StatusNotFound)
+		return
+	}
+
 	// Fetch messages from the database
-	messages, err := db.GetMessages(req.Sender, req.Receiver)
+	messages, err := store.GetMessages(acc.User.ID, contact.ID)
 	if err != nil {
 		http.Error(w, "Failed to fetch messages", http.StatusInternalServerError)
 		return
@@ -424,6 +744,24 @@ func fetchMessagesHandler(w http.ResponseWriter, r *http.Request) {
 		fmt.Println("No messages found")
 	}
 
+	// Decrypt with the keys the node holds, the client only sees plaintext
+	if err := acc.decryptMessages(messages); err != nil {
+		http.Error(w, "Failed to decrypt messages", http.StatusInternalServerError)
+		return
+	}
+
+	// Clients show the contact under the nickname the owner gave them
+	for i, msg := range messages {
+		if msg.Outgoing {
+			messages[i].Receiver = contact.Nickname
+		} else {
+			messages[i].Sender = contact.Nickname
+		}
+	}
+
+	// Serving the conversation to its owner marks the contact's messages as read
+	acc.markRead(contact)
+
 	// Write the messages as JSON response
 	w.WriteHeader(http.StatusOK)
 	if err := json.NewEncoder(w).Encode(messages); err != nil {
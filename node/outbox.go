@@ -0,0 +1,199 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sote/db"
+	"time"
+)
+
+// Delivery of queued messages. Messages that can't be delivered are retried with
+// backoff until the peer acknowledges them or outboxMaxAge has passed.
+const (
+	outboxRetryDelay    = 15 * time.Second
+	outboxMaxRetryDelay = time.Hour
+	outboxMaxAge        = 7 * 24 * time.Hour
+	outboxPollInterval  = 15 * time.Second
+)
+
+// newMessageID returns a random UUID (version 4) that identifies a message on both sides
+func newMessageID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16]), nil
+}
+
+// peerMessage is the body of /receive-message
+type peerMessage struct {
+	ID       string `json:"id"`
+	Sender   string `json:"sender"`
+	Receiver string `json:"receiver"`
+	Message  string `json:"message"`
+	SentAt   int64  `json:"sentAt"`
+	Seq      int    `json:"seq"`
+	// Group is set on /receive-group-message, the receiver is the group then
+	Group string `json:"group,omitempty"`
+}
+
+// wakeOutbox makes deliverOutbox look at the outbox right away
+func (acc *account) wakeOutbox() {
+	select {
+	case acc.outboxWake <- struct{}{}:
+	default:
+	}
+}
+
+// deliverOutbox sends the account's queued messages, receipts and group member lists until the account is deactivated
+func (acc *account) deliverOutbox() {
+	ticker := time.NewTicker(outboxPollInterval)
+	defer ticker.Stop()
+
+	for {
+		entries, err := store.GetDueOutbox(acc.User.ID, time.Now())
+		if err != nil {
+			fmt.Println("Error reading outbox:", err) // Debug print
+		}
+		for _, entry := range entries {
+			select {
+			case <-acc.stop:
+				return
+			default:
+			}
+			acc.deliverOutboxEntry(entry)
+		}
+
+		receipts, err := store.GetDueReceipts(acc.User.ID, time.Now())
+		if err != nil {
+			fmt.Println("Error reading queued receipts:", err) // Debug print
+		}
+		for _, receipt := range receipts {
+			select {
+			case <-acc.stop:
+				return
+			default:
+			}
+			acc.deliverReceipt(receipt)
+		}
+
+		updates, err := store.GetDueGroupUpdates(acc.User.ID, time.Now())
+		if err != nil {
+			fmt.Println("Error reading queued group updates:", err) // Debug print
+		}
+		for _, update := range updates {
+			select {
+			case <-acc.stop:
+				return
+			default:
+			}
+			acc.deliverGroupUpdate(update)
+		}
+
+		select {
+		case <-acc.stop:
+			return
+		case <-acc.outboxWake:
+		case <-ticker.C:
+		}
+	}
+}
+
+// outboxDelay is the backoff after a number of failed attempts
+func outboxDelay(attempts int) time.Duration {
+	delay := outboxRetryDelay << uint(attempts)
+	if delay > outboxMaxRetryDelay || delay <= 0 {
+		delay = outboxMaxRetryDelay
+	}
+	return delay
+}
+
+// peerRefused reports whether a peer's answer means a request should not be sent again.
+// Peers answer 422 when they checked a request and refuse it. 401 and 403 aren't final, they come from
+// clocks that are off or from peers that didn't get our contact reply yet, so those are retried.
+func peerRefused(statusCode int) bool {
+	return statusCode == http.StatusBadRequest || statusCode == http.StatusUnprocessableEntity
+}
+
+// deliverOutboxEntry makes one delivery attempt and records its outcome
+func (acc *account) deliverOutboxEntry(entry db.OutboxEntry) {
+	if entry.UUID == "" {
+		// Queued before messages had IDs, peers don't accept it anymore
+		fmt.Println("Dropping queued message without id:", entry.MessageID) // Debug print
+		if err := store.FinishOutbox(entry, db.MessageFailed); err != nil {
+			fmt.Println("Error updating outbox:", err) // Debug print
+		}
+		return
+	}
+
+	jsonData, err := json.Marshal(peerMessage{
+		ID:       entry.UUID,
+		Sender:   entry.Sender,
+		Receiver: entry.Receiver,
+		Message:  string(entry.Payload),
+		SentAt:   entry.SentAt,
+		Seq:      entry.Seq,
+		Group:    entry.GroupID,
+	})
+	if err != nil {
+		fmt.Println("Error encoding queued message:", err) // Debug print
+		return
+	}
+
+	path := "/receive-message"
+	if entry.GroupID != "" {
+		path = "/receive-group-message"
+	}
+	resp, err := acc.postToPeer(entry.OnionAddress, path, jsonData)
+	if err == nil {
+		resp.Body.Close()
+		switch {
+		case resp.StatusCode >= 200 && resp.StatusCode < 300:
+			// The peer has the message, its receipt tells when it was delivered
+			if err := store.FinishOutbox(entry, db.MessageSent); err != nil {
+				fmt.Println("Error updating outbox:", err) // Debug print
+			}
+			fmt.Println("Message sent to:", entry.OnionAddress) // Debug print
+			acc.publishDelivery(entry, db.MessageSent)
+			return
+		case peerRefused(resp.StatusCode):
+			// The peer refused the message, sending it again won't change that
+			fmt.Printf("Message to %s was refused: %s\n", entry.OnionAddress, resp.Status)
+			if err := store.FinishOutbox(entry, db.MessageFailed); err != nil {
+				fmt.Println("Error updating outbox:", err) // Debug print
+			}
+			acc.publishDelivery(entry, db.MessageFailed)
+			return
+		}
+		err = fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	if time.Now().After(entry.Expires) {
+		fmt.Printf("Giving up on message to %s: %v\n", entry.OnionAddress, err)
+		if err := store.FinishOutbox(entry, db.MessageFailed); err != nil {
+			fmt.Println("Error updating outbox:", err) // Debug print
+		}
+		acc.publishDelivery(entry, db.MessageFailed)
+		return
+	}
+
+	delay := outboxDelay(entry.Attempts)
+	fmt.Printf("Failed to deliver message to %s (%v), retrying in %v\n", entry.OnionAddress, err, delay)
+	if err := store.RetryOutbox(entry, time.Now().Add(delay), err.Error()); err != nil {
+		fmt.Println("Error updating outbox:", err) // Debug print
+	}
+}
+
+// publishDelivery tells the account's clients about a new delivery state of a message
+func (acc *account) publishDelivery(entry db.OutboxEntry, state string) {
+	acc.publish(deliveryEvent, map[string]interface{}{
+		"id":       entry.UUID,
+		"receiver": entry.Receiver,
+		"contact":  entry.Contact,
+		"state":    state,
+	})
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sote/tor"
+	"sote/user"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Headers of a signed peer request. The caller names its onion address and signs
+// the request with the PGP key that belongs to it, and with the onion service's key
+// so the onion address can't be claimed by someone else.
+const (
+	peerOnionHeader          = "X-Sote-Onion"
+	peerTimestampHeader      = "X-Sote-Timestamp"
+	peerSignatureHeader      = "X-Sote-Signature"
+	peerOnionSignatureHeader = "X-Sote-Onion-Signature"
+)
+
+// peerRequestMaxAge is how far the timestamp of a signed request may be off
+const peerRequestMaxAge = 5 * time.Minute
+
+// contactContextKey stores the contact that signed a peer request
+type contactContextKey struct{}
+
+// seenSignatures remembers recent signatures so a captured request can't be replayed
+var seenSignatures = make(map[string]time.Time)
+var seenSignaturesMu sync.Mutex
+
+// peerRequestPayload is the data a peer request signature covers
+func peerRequestPayload(method, targetOnion, path, timestamp string, body []byte) []byte {
+	bodyHash := sha256.Sum256(body)
+	return []byte(strings.Join([]string{method, normalizeOnion(targetOnion), path, timestamp, hex.EncodeToString(bodyHash[:])}, "\n"))
+}
+
+// normalizeOnion cleans an onion address so addresses from different sources compare equal
+func normalizeOnion(onionAddress string) string {
+	return strings.ToLower(strings.TrimSpace(onionAddress))
+}
+
+// postToPeer sends a JSON request signed with the account's key to a peer's onion service
+func (acc *account) postToPeer(onionAddress, path string, jsonData []byte) (*http.Response, error) {
+	onionAddress = normalizeOnion(onionAddress)
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	payload := peerRequestPayload(http.MethodPost, onionAddress, path, timestamp, jsonData)
+	signature, err := user.SignDetached(acc.User.KeyRing, payload)
+	if err != nil {
+		return nil, err
+	}
+	onionSignature, err := tor.SignWithOnionKey(acc.onionKey, payload)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, tor.OnionURL(onionAddress, path), bytes.NewBuffer(jsonData))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(peerOnionHeader, acc.User.OnionAddress)
+	req.Header.Set(peerTimestampHeader, timestamp)
+	req.Header.Set(peerSignatureHeader, base64.StdEncoding.EncodeToString(signature))
+	req.Header.Set(peerOnionSignatureHeader, base64.StdEncoding.EncodeToString(onionSignature))
+
+	client, err := acc.httpClient()
+	if err != nil {
+		return nil, err
+	}
+	return client.Do(req)
+}
+
+// readPeerRequest reads the body of a signed peer request and returns it with the caller's onion address.
+// The body is put back so handlers can decode it.
+func readPeerRequest(r *http.Request) (string, []byte, error) {
+	onionAddress := normalizeOnion(r.Header.Get(peerOnionHeader))
+	if onionAddress == "" || r.Header.Get(peerSignatureHeader) == "" {
+		return "", nil, errors.New("request is not signed")
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, 1<<20))
+	if err != nil {
+		return "", nil, err
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	return onionAddress, body, nil
+}
+
+// verifyPeerRequest checks that a peer request was signed with publicKey and the key of the onion
+// address it names, is recent and wasn't seen before
+func verifyPeerRequest(r *http.Request, acc *account, body []byte, publicKey []byte) error {
+	timestamp := r.Header.Get(peerTimestampHeader)
+	unix, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return errors.New("invalid request timestamp")
+	}
+	age := time.Since(time.Unix(unix, 0))
+	if age > peerRequestMaxAge || age < -peerRequestMaxAge {
+		return errors.New("request timestamp is too far off")
+	}
+
+	encodedSignature := r.Header.Get(peerSignatureHeader)
+	signature, err := base64.StdEncoding.DecodeString(encodedSignature)
+	if err != nil {
+		return errors.New("invalid request signature")
+	}
+	payload := peerRequestPayload(r.Method, acc.User.OnionAddress, r.URL.Path, timestamp, body)
+	if err := user.VerifyDetached(publicKey, payload, signature); err != nil {
+		return fmt.Errorf("request signature could not be verified: %v", err)
+	}
+	onionSignature, err := base64.StdEncoding.DecodeString(r.Header.Get(peerOnionSignatureHeader))
+	if err != nil {
+		return errors.New("invalid onion signature")
+	}
+	if err := tor.VerifyOnionSignature(normalizeOnion(r.Header.Get(peerOnionHeader)), payload, onionSignature); err != nil {
+		return err
+	}
+
+	seenSignaturesMu.Lock()
+	defer seenSignaturesMu.Unlock()
+	for s, seen := range seenSignatures {
+		if time.Since(seen) > 2*peerRequestMaxAge {
+			delete(seenSignatures, s)
+		}
+	}
+	if _, ok := seenSignatures[encodedSignature]; ok {
+		return errors.New("request was replayed")
+	}
+	seenSignatures[encodedSignature] = time.Now()
+	return nil
+}
+
+// requireContact rejects peer requests that aren't signed by one of the account's contacts
+func requireContact(h http.HandlerFunc) http.HandlerFunc {
+	return peerOnly(func(w http.ResponseWriter, r *http.Request) {
+		acc, err := accountFromPeer(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		onionAddress, body, err := readPeerRequest(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		contact, err := store.GetContactByOnionAddress(acc.User.ID, onionAddress)
+		if err != nil {
+			fmt.Println("Rejected peer request from unknown onion address:", onionAddress) // Debug print
+			http.Error(w, "Unknown contact", http.StatusForbidden)
+			return
+		}
+		if err := verifyPeerRequest(r, acc, body, contact.PublicKey); err != nil {
+			fmt.Println("Rejected peer request from", contact.Username, err) // Debug print
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		h(w, r.WithContext(context.WithValue(r.Context(), contactContextKey{}, contact)))
+	})
+}
+
+// contactFromPeer returns the contact that signed a request let through by requireContact
+func contactFromPeer(r *http.Request) (user.Contact, error) {
+	contact, ok := r.Context().Value(contactContextKey{}).(user.Contact)
+	if !ok {
+		return user.Contact{}, errors.New("request is not from a contact")
+	}
+	return contact, nil
+}
+
+// verifySelfSignedPeer checks a peer request from someone who isn't a contact yet.
+// The request must be signed by the public key it carries and by the key of the onion address it names.
+func verifySelfSignedPeer(r *http.Request, acc *account, onionAddress string, body []byte, claimedOnion string, publicKey []byte) error {
+	if onionAddress != normalizeOnion(claimedOnion) {
+		return errors.New("onion address does not match the request")
+	}
+	return verifyPeerRequest(r, acc, body, publicKey)
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sote/db"
+	"sote/user"
+	"time"
+)
+
+// receipt is the control message a receiver sends back for messages it got or its owner read
+type receipt struct {
+	Kind string   `json:"kind"`
+	IDs  []string `json:"ids"`
+	At   int64    `json:"at"`
+}
+
+// queueReceipt encrypts a receipt to a contact, signs it and queues it for deliverOutbox
+func (acc *account) queueReceipt(contact user.Contact, kind string, uuids []string) error {
+	if len(uuids) == 0 {
+		return nil
+	}
+	data, err := json.Marshal(receipt{Kind: kind, IDs: uuids, At: time.Now().Unix()})
+	if err != nil {
+		return err
+	}
+	payload, err := user.EncryptMessage(data, contact.PublicKey, acc.User.KeyRing)
+	if err != nil {
+		return err
+	}
+	err = store.QueueReceipt(acc.User.ID, contact.OnionAddress, payload, time.Now().Add(outboxMaxAge))
+	if err != nil {
+		return err
+	}
+	acc.wakeOutbox()
+	return nil
+}
+
+// deliverReceipt makes one delivery attempt of a queued receipt
+func (acc *account) deliverReceipt(queued db.QueuedReceipt) {
+	jsonData, err := json.Marshal(map[string]string{
+		"receipt": string(queued.Payload),
+	})
+	if err != nil {
+		fmt.Println("Error encoding receipt:", err) // Debug print
+		return
+	}
+
+	resp, err := acc.postToPeer(queued.OnionAddress, "/receive-receipt", jsonData)
+	if err == nil {
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusOK || peerRefused(resp.StatusCode) {
+			if err := store.DeleteReceipt(queued); err != nil {
+				fmt.Println("Error removing receipt:", err) // Debug print
+			}
+			return
+		}
+		err = fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	// Receipts are a courtesy, they are dropped with the messages they belong to
+	if time.Now().After(queued.Expires) {
+		if err := store.DeleteReceipt(queued); err != nil {
+			fmt.Println("Error removing receipt:", err) // Debug print
+		}
+		return
+	}
+	delay := outboxDelay(queued.Attempts)
+	fmt.Printf("Failed to deliver receipt to %s (%v), retrying in %v\n", queued.OnionAddress, err, delay)
+	if err := store.RetryReceipt(queued, time.Now().Add(delay)); err != nil {
+		fmt.Println("Error updating receipt:", err) // Debug print
+	}
+}
+
+// receiveReceiptHandler records a contact's receipt on the messages we sent them
+func receiveReceiptHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Receipt string `json:"receipt"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	acc, err := accountFromPeer(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	contact, err := contactFromPeer(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	// The receipt must be signed by the contact, like a message
+	data, err := user.DecryptMessage([]byte(req.Receipt), acc.User.KeyRing, contact.PublicKey)
+	if err != nil {
+		http.Error(w, "Receipt signature could not be verified", http.StatusUnprocessableEntity)
+		return
+	}
+	var rec receipt
+	if err := json.Unmarshal([]byte(data), &rec); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if rec.Kind != db.DeliveredReceipt && rec.Kind != db.ReadReceipt {
+		http.Error(w, "Unknown receipt kind", http.StatusBadRequest)
+		return
+	}
+	at := time.Unix(rec.At, 0)
+	if rec.At <= 0 || at.After(time.Now()) {
+		at = time.Now()
+	}
+
+	err = store.RecordReceipt(acc.User.ID, contact.ID, rec.Kind, rec.IDs, at)
+	if err != nil {
+		http.Error(w, "Failed to save receipt", http.StatusInternalServerError)
+		return
+	}
+	fmt.Printf("%s receipt from %s for %d message(s)\n", rec.Kind, contact.Nickname, len(rec.IDs)) // Debug print
+	acc.publish(receiptEvent, map[string]interface{}{
+		"contact": contact.Nickname,
+		"kind":    rec.Kind,
+		"ids":     rec.IDs,
+		"at":      at.Unix(),
+	})
+	w.WriteHeader(http.StatusOK)
+}
+
+// markRead marks the contact's messages as read and sends a read receipt for them
+func (acc *account) markRead(contact user.Contact) {
+	readIDs, err := store.MarkMessagesRead(acc.User.ID, contact.ID, time.Now())
+	if err != nil {
+		fmt.Println("Error marking messages read:", err) // Debug print
+		return
+	}
+	if len(readIDs) == 0 {
+		return
+	}
+	if err := acc.sendReceiptIfEnabled(contact, db.ReadReceipt, readIDs); err != nil {
+		fmt.Println("Error queueing read receipt:", err) // Debug print
+	}
+}
+
+// markReadHandler marks a conversation as read, used by clients that show messages from /events
+func markReadHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Contact string `json:"contact"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	acc, err := accountFromSession(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	contact, err := store.GetContact(acc.User.ID, req.Contact)
+	if err != nil {
+		http.Error(w, "Contact not found", http.StatusNotFound)
+		return
+	}
+	acc.markRead(contact)
+	w.WriteHeader(http.StatusOK)
+}
+
+// receiptSettingsHandler returns and optionally changes which receipts are sent to a contact
+func receiptSettingsHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Contact          string `json:"contact"`
+		DeliveryReceipts *bool  `json:"deliveryReceipts"`
+		ReadReceipts     *bool  `json:"readReceipts"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	acc, err := accountFromSession(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	contact, err := store.GetContact(acc.User.ID, req.Contact)
+	if err != nil {
+		http.Error(w, "Contact not found", http.StatusNotFound)
+		return
+	}
+	delivered, read, err := store.GetReceiptSettings(acc.User.ID, contact.ID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if req.DeliveryReceipts != nil {
+		delivered = *req.DeliveryReceipts
+	}
+	if req.ReadReceipts != nil {
+		read = *req.ReadReceipts
+	}
+	if req.DeliveryReceipts != nil || req.ReadReceipts != nil {
+		err = store.SetReceiptSettings(acc.User.ID, contact.ID, delivered, read)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	json.NewEncoder(w).Encode(map[string]bool{
+		"deliveryReceipts": delivered,
+		"readReceipts":     read,
+	})
+}
+
+// sendReceiptIfEnabled queues a receipt of the given kind if the owner sends those to the contact
+func (acc *account) sendReceiptIfEnabled(contact user.Contact, kind string, uuids []string) error {
+	delivered, read, err := store.GetReceiptSettings(acc.User.ID, contact.ID)
+	if err != nil {
+		return err
+	}
+	switch kind {
+	case db.DeliveredReceipt:
+		if !delivered {
+			return nil
+		}
+	case db.ReadReceipt:
+		if !read {
+			return nil
+		}
+	default:
+		return errors.New("unknown receipt kind")
+	}
+	return acc.queueReceipt(contact, kind, uuids)
+}
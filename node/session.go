@@ -0,0 +1,98 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// sessionHeader carries the local session token issued by loginHandler
+const sessionHeader = "Authorization"
+
+// session holds the state of a client that logged in through the local API
+type session struct {
+	Username string
+}
+
+var sessions = make(map[string]*session)
+var sessionsMu sync.Mutex
+
+// newSession creates a random session token for the given username
+func newSession(username string) (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	token := hex.EncodeToString(b)
+
+	sessionsMu.Lock()
+	sessions[token] = &session{Username: username}
+	sessionsMu.Unlock()
+	return token, nil
+}
+
+// sessionToken extracts the bearer token from the request, if any
+func sessionToken(r *http.Request) string {
+	h := r.Header.Get(sessionHeader)
+	if !strings.HasPrefix(h, "Bearer ") {
+		return ""
+	}
+	return strings.TrimSpace(strings.TrimPrefix(h, "Bearer "))
+}
+
+// getSession returns the session that belongs to the request's token
+func getSession(r *http.Request) (*session, bool) {
+	token := sessionToken(r)
+	if token == "" {
+		return nil, false
+	}
+	sessionsMu.Lock()
+	defer sessionsMu.Unlock()
+	s, ok := sessions[token]
+	return s, ok
+}
+
+// deleteSession removes the session of the request's token.
+// It returns the session's username and whether that user has other sessions left.
+func deleteSession(r *http.Request) (string, bool) {
+	token := sessionToken(r)
+
+	sessionsMu.Lock()
+	defer sessionsMu.Unlock()
+	s, ok := sessions[token]
+	if !ok {
+		return "", false
+	}
+	delete(sessions, token)
+
+	for _, other := range sessions {
+		if other.Username == s.Username {
+			return s.Username, true
+		}
+	}
+	return s.Username, false
+}
+
+// requireSession rejects requests without a valid session token
+func requireSession(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := getSession(r); !ok {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		h(w, r)
+	}
+}
+
+// peerOnly rejects callers that present local session credentials
+func peerOnly(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get(sessionHeader) != "" {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		h(w, r)
+	}
+}
@@ -0,0 +1,116 @@
+package tor
+
+import (
+	"fmt"
+	"os/exec"
+	"regexp"
+	"strings"
+)
+
+// supportedTransports are the pluggable transports a bridge line may use
+var supportedTransports = map[string]bool{
+	"obfs4":     true,
+	"snowflake": true,
+	"meek_lite": true,
+}
+
+// defaultTransportPlugins are looked up in PATH when no ClientTransportPlugin is configured
+var defaultTransportPlugins = []string{"lyrebird", "obfs4proxy"}
+
+// quotedBridge matches one bridge line of the list encoded in BridgeDB's QR codes
+var quotedBridge = regexp.MustCompile(`'([^']*)'|"([^"]*)"`)
+
+// ParseBridgeLine validates a bridge line and returns it in torrc form.
+// The leading "Bridge" keyword is optional and meek-lite is accepted for meek_lite.
+func ParseBridgeLine(line string) (string, error) {
+	fields := strings.Fields(line)
+	if len(fields) > 0 && strings.EqualFold(fields[0], "Bridge") {
+		fields = fields[1:]
+	}
+	if len(fields) == 0 {
+		return "", fmt.Errorf("empty bridge line")
+	}
+
+	transport := bridgeTransport(fields)
+	if transport == "meek-lite" {
+		transport = "meek_lite"
+		fields[0] = transport
+	}
+	if transport != "" && !supportedTransports[transport] {
+		return "", fmt.Errorf("unsupported pluggable transport %q", transport)
+	}
+	if transport != "" && len(fields) < 2 {
+		return "", fmt.Errorf("bridge line has no address: %q", line)
+	}
+	return strings.Join(fields, " "), nil
+}
+
+// ParseBridgeLines reads the bridge lines of a file or of a scanned QR payload.
+// BridgeDB encodes its QR codes as a list of quoted lines, files have one line each.
+func ParseBridgeLines(text string) ([]string, error) {
+	var candidates []string
+	trimmed := strings.TrimSpace(text)
+	if strings.HasPrefix(trimmed, "[") {
+		for _, match := range quotedBridge.FindAllStringSubmatch(trimmed, -1) {
+			candidates = append(candidates, match[1]+match[2])
+		}
+	} else {
+		candidates = strings.Split(trimmed, "\n")
+	}
+
+	var lines []string
+	for _, candidate := range candidates {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "" || strings.HasPrefix(candidate, "#") {
+			continue
+		}
+		line, err := ParseBridgeLine(candidate)
+		if err != nil {
+			return nil, err
+		}
+		lines = append(lines, line)
+	}
+	return lines, nil
+}
+
+// bridgeTransport returns the transport of a bridge line, vanilla bridges start with their address
+func bridgeTransport(fields []string) string {
+	if strings.Contains(fields[0], ":") {
+		return ""
+	}
+	return strings.ToLower(fields[0])
+}
+
+// DefaultTransportPlugin finds a pluggable transport client in PATH
+func DefaultTransportPlugin() string {
+	for _, name := range defaultTransportPlugins {
+		if path, err := exec.LookPath(name); err == nil {
+			return path
+		}
+	}
+	return ""
+}
+
+// bridgeConfig returns the torrc lines that make tor connect through the configured bridges
+func (c *Config) bridgeConfig() string {
+	if len(c.Bridges) == 0 {
+		return ""
+	}
+
+	var b strings.Builder
+	b.WriteString("UseBridges 1\n")
+	var transports []string
+	seen := make(map[string]bool)
+	for _, line := range c.Bridges {
+		fmt.Fprintf(&b, "Bridge %s\n", line)
+		transport := bridgeTransport(strings.Fields(line))
+		if transport != "" && !seen[transport] {
+			seen[transport] = true
+			transports = append(transports, transport)
+		}
+	}
+	if len(transports) > 0 && c.TransportPlugin != "" {
+		fmt.Fprintf(&b, "ClientTransportPlugin %s exec %s\n", strings.Join(transports, ","), c.TransportPlugin)
+	}
+	return b.String()
+}
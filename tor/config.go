@@ -0,0 +1,111 @@
+package tor
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+)
+
+// OnionPort is the virtual port every account's onion service listens on
+const OnionPort = 18080
+
+// Config holds the tor settings of one account
+type Config struct {
+	TorrcFile     string
+	DataDirectory string
+	SocksPort     int
+	ControlPort   int
+	// ServicePort is the local port the onion service forwards to
+	ServicePort int
+	// Bridges are bridge lines in torrc form, TransportPlugin runs their pluggable transports
+	Bridges         []string
+	TransportPlugin string
+}
+
+// NewConfig returns the config of a torrc file, its DataDirectory lives next to it.
+// Ports that are zero get allocated by AllocatePorts.
+func NewConfig(torrcFile string, socksPort, controlPort, servicePort int) *Config {
+	return &Config{
+		TorrcFile:     torrcFile,
+		DataDirectory: filepath.Join(filepath.Dir(torrcFile), "data"),
+		SocksPort:     socksPort,
+		ControlPort:   controlPort,
+		ServicePort:   servicePort,
+	}
+}
+
+// AllocatePorts replaces unset ports and ports another process took with free ones.
+// When keepTorPorts is set the SocksPort and ControlPort are left alone, because
+// an already running tor holds them. It reports whether any port changed.
+func (c *Config) AllocatePorts(keepTorPorts bool) (bool, error) {
+	changed := false
+	ports := []*int{&c.ServicePort}
+	if !keepTorPorts {
+		ports = append(ports, &c.SocksPort, &c.ControlPort)
+	}
+	for _, port := range ports {
+		if *port != 0 && PortFree(*port) {
+			continue
+		}
+		free, err := FreePort()
+		if err != nil {
+			return changed, err
+		}
+		*port = free
+		changed = true
+	}
+	return changed, nil
+}
+
+// WriteTorrc writes the torrc file of this config
+func (c *Config) WriteTorrc() error {
+	torConfig := fmt.Sprintf(`DataDirectory %s
+CookieAuthentication 1
+SocksPort 127.0.0.1:%d
+ControlPort 127.0.0.1:%d
+%s`, c.DataDirectory, c.SocksPort, c.ControlPort, c.bridgeConfig())
+
+	err := os.WriteFile(c.TorrcFile, []byte(torConfig), 0600)
+	if err != nil {
+		fmt.Println("Error writing tor configuration:", err) // Debug print
+		return err
+	}
+	fmt.Println("Tor configuration written to:", c.TorrcFile) // Debug print
+	return nil
+}
+
+// ProxyURL returns the URL of this tor's SOCKS proxy
+func (c *Config) ProxyURL() string {
+	return fmt.Sprintf("socks5://127.0.0.1:%d", c.SocksPort)
+}
+
+// ServiceAddress returns the local address the onion service forwards to
+func (c *Config) ServiceAddress() string {
+	return fmt.Sprintf("127.0.0.1:%d", c.ServicePort)
+}
+
+// OnionURL returns the URL of path on a peer's onion service
+func OnionURL(onionAddress, path string) string {
+	return fmt.Sprintf("https://%s:%d%s", onionAddress, OnionPort, path)
+}
+
+// FreePort asks the kernel for a free loopback port
+func FreePort() (int, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return 0, err
+	}
+	defer listener.Close()
+	return listener.Addr().(*net.TCPAddr).Port, nil
+}
+
+// PortFree reports whether a loopback port can be listened on
+func PortFree(port int) bool {
+	listener, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+	if err != nil {
+		return false
+	}
+	listener.Close()
+	return true
+}
@@ -0,0 +1,144 @@
+package tor
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/cretz/bine/control"
+	"github.com/cretz/bine/torutil"
+	"github.com/cretz/bine/torutil/ed25519"
+)
+
+// hsSecretKeyHeader prefixes the expanded key in a hidden service's hs_ed25519_secret_key file
+const hsSecretKeyHeader = "== ed25519v1-secret: type0 ==\x00\x00\x00"
+
+// GenerateOnionKey creates a new ED25519 onion service key.
+// It returns the .onion address and the key in the base64 form ADD_ONION expects.
+func GenerateOnionKey() (string, string, error) {
+	keyPair, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return "", "", err
+	}
+	onionAddress := torutil.OnionServiceIDFromV3PublicKey(keyPair.PublicKey()) + ".onion"
+	key := base64.StdEncoding.EncodeToString(keyPair.PrivateKey())
+	return onionAddress, key, nil
+}
+
+// SignWithOnionKey signs message with an onion service key in the base64 form ADD_ONION takes,
+// the signature proves control of the key's .onion address
+func SignWithOnionKey(key string, message []byte) ([]byte, error) {
+	privateKey, err := base64.StdEncoding.DecodeString(key)
+	if err != nil || len(privateKey) != ed25519.PrivateKeySize {
+		return nil, errors.New("invalid onion key")
+	}
+	return ed25519.Sign(ed25519.PrivateKey(privateKey).KeyPair(), message), nil
+}
+
+// VerifyOnionSignature checks that signature was made by the key of onionAddress
+func VerifyOnionSignature(onionAddress string, message, signature []byte) error {
+	publicKey, err := torutil.PublicKeyFromV3OnionServiceID(strings.TrimSuffix(onionAddress, ".onion"))
+	if err != nil {
+		return fmt.Errorf("invalid onion address: %v", err)
+	}
+	if !ed25519.Verify(publicKey, message, signature) {
+		return errors.New("onion signature could not be verified")
+	}
+	return nil
+}
+
+// AddOnion publishes the onion service of key through the control port.
+// The service forwards virtualPort to target and lives as long as this TorProcess,
+// it is published again when tor restarts.
+func (p *TorProcess) AddOnion(key string, virtualPort int, target string) (string, error) {
+	onionKey, err := control.ED25519KeyFromBlob(key)
+	if err != nil {
+		return "", fmt.Errorf("invalid onion key: %v", err)
+	}
+	req := &control.AddOnionRequest{
+		Key:   onionKey,
+		Ports: []*control.KeyVal{{Key: fmt.Sprint(virtualPort), Val: target}},
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	serviceID, err := p.addOnionLocked(req)
+	if err != nil {
+		return "", err
+	}
+	p.onions = append(p.onions, req)
+	return serviceID + ".onion", nil
+}
+
+// addOnionLocked sends ADD_ONION on the long lived control connection, p.mu must be held
+func (p *TorProcess) addOnionLocked(req *control.AddOnionRequest) (string, error) {
+	if p.ctrl == nil {
+		conn, err := p.Control()
+		if err != nil {
+			return "", err
+		}
+		p.ctrl = conn
+	}
+	resp, err := p.ctrl.AddOnion(req)
+	if err != nil {
+		p.ctrl.Close()
+		p.ctrl = nil
+		return "", err
+	}
+	fmt.Println("Onion service published:", resp.ServiceID) // Debug print
+	return resp.ServiceID, nil
+}
+
+// restoreOnions publishes the onion services again after tor restarted
+func (p *TorProcess) restoreOnions() {
+	if err := p.WaitBootstrap(bootstrapRestoreTimeout); err != nil {
+		fmt.Println("Error restoring onion services:", err) // Debug print
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.ctrl != nil {
+		p.ctrl.Close()
+		p.ctrl = nil
+	}
+	for _, req := range p.onions {
+		if _, err := p.addOnionLocked(req); err != nil {
+			fmt.Println("Error restoring onion service:", err) // Debug print
+		}
+	}
+}
+
+// HiddenServiceKey reads the onion key of the HiddenServiceDir a torrc file points to.
+// It returns the directory and the key in ADD_ONION form, or empty strings if the torrc has none.
+func HiddenServiceKey(configFile string) (string, string, error) {
+	content, err := os.ReadFile(configFile)
+	if err != nil {
+		return "", "", err
+	}
+
+	var hiddenServiceDir string
+	for _, line := range strings.Split(string(content), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 2 && fields[0] == "HiddenServiceDir" {
+			hiddenServiceDir = fields[1]
+		}
+	}
+	if hiddenServiceDir == "" {
+		return "", "", nil
+	}
+
+	secret, err := os.ReadFile(filepath.Join(hiddenServiceDir, "hs_ed25519_secret_key"))
+	if err != nil {
+		return "", "", err
+	}
+	if len(secret) != len(hsSecretKeyHeader)+ed25519.PrivateKeySize || !strings.HasPrefix(string(secret), hsSecretKeyHeader) {
+		return "", "", errors.New("unknown hs_ed25519_secret_key format")
+	}
+	key := base64.StdEncoding.EncodeToString(secret[len(hsSecretKeyHeader):])
+	return hiddenServiceDir, key, nil
+}
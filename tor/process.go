@@ -0,0 +1,224 @@
+package tor
+
+import (
+	"errors"
+	"fmt"
+	"net/textproto"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/cretz/bine/control"
+)
+
+// TorProcess is a tor instance that runs with one account's Config
+type TorProcess struct {
+	Config *Config
+
+	mu      sync.Mutex
+	cmd     *exec.Cmd
+	stopped bool
+	exited  chan struct{}
+	ctrl    *control.Conn
+	onions  []*control.AddOnionRequest
+}
+
+// bootstrapRestoreTimeout is how long a restarted tor may take before its onion services are given up
+const bootstrapRestoreTimeout = 5 * time.Minute
+
+// NewTorProcess returns the process of a config, nothing is started yet
+func NewTorProcess(config *Config) *TorProcess {
+	return &TorProcess{Config: config}
+}
+
+// IsRunning reports whether a tor process holds the DataDirectory of this torrc.
+// Tor locks DataDirectory/lock while it runs, so this also finds processes the node didn't start.
+func (p *TorProcess) IsRunning() bool {
+	f, err := os.Open(filepath.Join(p.Config.DataDirectory, "lock"))
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+
+	err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if err != nil {
+		return errors.Is(err, syscall.EWOULDBLOCK)
+	}
+	syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+	return false
+}
+
+// Start starts tor unless it is already running and waits until it has bootstrapped.
+// A tor started here is restarted when it crashes, until Stop is called.
+func (p *TorProcess) Start(timeout time.Duration) error {
+	p.mu.Lock()
+	p.stopped = false
+	if p.cmd == nil && !p.IsRunning() {
+		if err := p.startLocked(); err != nil {
+			p.mu.Unlock()
+			return err
+		}
+	} else {
+		fmt.Println("Tor is already running with config file:", p.Config.TorrcFile) // Debug print
+	}
+	p.mu.Unlock()
+
+	return p.WaitBootstrap(timeout)
+}
+
+// startLocked starts the tor command, p.mu must be held
+func (p *TorProcess) startLocked() error {
+	cmd := exec.Command("tor", "-f", p.Config.TorrcFile)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	fmt.Println("Tor client started with config file:", p.Config.TorrcFile)
+
+	p.cmd = cmd
+	p.exited = make(chan struct{})
+	go p.watch(cmd, p.exited)
+	return nil
+}
+
+// watch waits for the tor command to exit and restarts it if it wasn't stopped
+func (p *TorProcess) watch(cmd *exec.Cmd, exited chan struct{}) {
+	restartDelay := 2 * time.Second
+	for {
+		err := cmd.Wait()
+		close(exited)
+
+		p.mu.Lock()
+		if p.stopped {
+			p.cmd = nil
+			p.mu.Unlock()
+			return
+		}
+		p.mu.Unlock()
+
+		fmt.Printf("Tor with config file %s exited (%v), restarting in %v\n", p.Config.TorrcFile, err, restartDelay)
+		time.Sleep(restartDelay)
+		if restartDelay < time.Minute {
+			restartDelay *= 2
+		}
+
+		p.mu.Lock()
+		if p.stopped {
+			p.cmd = nil
+			p.mu.Unlock()
+			return
+		}
+		cmd = exec.Command("tor", "-f", p.Config.TorrcFile)
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		if err := cmd.Start(); err != nil {
+			fmt.Println("Error restarting tor:", err) // Debug print
+			p.cmd = nil
+			p.mu.Unlock()
+			return
+		}
+		p.cmd = cmd
+		exited = make(chan struct{})
+		p.exited = exited
+		p.mu.Unlock()
+
+		go p.restoreOnions()
+	}
+}
+
+// Control opens an authenticated connection to the control port of this tor
+func (p *TorProcess) Control() (*control.Conn, error) {
+	tp, err := textproto.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", p.Config.ControlPort))
+	if err != nil {
+		return nil, err
+	}
+	conn := control.NewConn(tp)
+	if err := conn.Authenticate(""); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// WaitBootstrap polls the control port until tor reports 100% bootstrap progress
+func (p *TorProcess) WaitBootstrap(timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		progress, err := p.bootstrapProgress()
+		if err == nil && progress == 100 {
+			fmt.Println("Tor bootstrapped with config file:", p.Config.TorrcFile) // Debug print
+			return nil
+		}
+		if time.Now().After(deadline) {
+			if err != nil {
+				return fmt.Errorf("tor did not bootstrap in %v: %v", timeout, err)
+			}
+			return fmt.Errorf("tor did not bootstrap in %v, progress %d%%", timeout, progress)
+		}
+		time.Sleep(time.Second)
+	}
+}
+
+// bootstrapProgress reads the PROGRESS value of status/bootstrap-phase
+func (p *TorProcess) bootstrapProgress() (int, error) {
+	conn, err := p.Control()
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+
+	info, err := conn.GetInfo("status/bootstrap-phase")
+	if err != nil {
+		return 0, err
+	}
+	for _, kv := range info {
+		for _, field := range strings.Fields(kv.Val) {
+			if strings.HasPrefix(field, "PROGRESS=") {
+				return strconv.Atoi(strings.TrimPrefix(field, "PROGRESS="))
+			}
+		}
+	}
+	return 0, errors.New("no bootstrap progress reported")
+}
+
+// Stop shuts tor down through its control port and waits for it to exit
+func (p *TorProcess) Stop() error {
+	p.mu.Lock()
+	p.stopped = true
+	cmd, exited := p.cmd, p.exited
+	// Closing the control connection removes the onion services added through it
+	if p.ctrl != nil {
+		p.ctrl.Close()
+		p.ctrl = nil
+	}
+	p.onions = nil
+	p.mu.Unlock()
+
+	conn, err := p.Control()
+	if err == nil {
+		err = conn.Signal("SHUTDOWN")
+		conn.Close()
+	}
+	if cmd == nil {
+		// Not started by us, the control port is all we have
+		return err
+	}
+	if err != nil {
+		cmd.Process.Signal(syscall.SIGTERM)
+	}
+
+	select {
+	case <-exited:
+	case <-time.After(30 * time.Second):
+		cmd.Process.Kill()
+		<-exited
+	}
+	fmt.Println("Tor stopped with config file:", p.Config.TorrcFile)
+	return nil
+}
@@ -0,0 +1,131 @@
+package user
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+)
+
+// Argon2id parameters for new accounts
+const (
+	argon2Time    = 3
+	argon2Memory  = 64 * 1024
+	argon2Threads = 4
+	argon2KeyLen  = 32
+	saltLen       = 16
+)
+
+// KDFParams are the Argon2id parameters and salt of one derived key
+type KDFParams struct {
+	Salt    []byte
+	Time    uint32
+	Memory  uint32
+	Threads uint8
+}
+
+// NewKDFParams returns the default parameters with a new random salt
+func NewKDFParams() (KDFParams, error) {
+	salt := make([]byte, saltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return KDFParams{}, err
+	}
+	return KDFParams{Salt: salt, Time: argon2Time, Memory: argon2Memory, Threads: argon2Threads}, nil
+}
+
+// String encodes the parameters like a PHC string without the hash
+func (p KDFParams) String() string {
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s", argon2.Version, p.Memory, p.Time, p.Threads, base64.RawStdEncoding.EncodeToString(p.Salt))
+}
+
+// ParseKDFParams decodes parameters encoded by KDFParams.String
+func ParseKDFParams(encoded string) (KDFParams, error) {
+	params, _, err := parsePHC(encoded, 5)
+	return params, err
+}
+
+// DeriveKey derives a 32-byte key from the password with Argon2id
+func DeriveKey(password string, p KDFParams) []byte {
+	return argon2.IDKey([]byte(password), p.Salt, p.Time, p.Memory, p.Threads, argon2KeyLen)
+}
+
+// HashPassword returns the login verifier of a password as a PHC string.
+// It uses its own salt, so it never equals the key that encrypts the account's secrets.
+func HashPassword(password string) (string, error) {
+	p, err := NewKDFParams()
+	if err != nil {
+		return "", err
+	}
+	hash := DeriveKey(password, p)
+	return p.String() + "$" + base64.RawStdEncoding.EncodeToString(hash), nil
+}
+
+// IsLegacyPasswordHash reports whether a stored hash comes from before Argon2id
+func IsLegacyPasswordHash(stored string) bool {
+	return !strings.HasPrefix(stored, "$argon2id$")
+}
+
+// VerifyPassword checks a password against a stored verifier, legacy hashes included
+func VerifyPassword(password, stored string) bool {
+	if IsLegacyPasswordHash(stored) {
+		return subtle.ConstantTimeCompare([]byte(legacyHashPassword(password)), []byte(stored)) == 1
+	}
+
+	p, hash, err := parsePHC(stored, 6)
+	if err != nil {
+		return false
+	}
+	return subtle.ConstantTimeCompare(DeriveKey(password, p), hash) == 1
+}
+
+// parsePHC decodes "$argon2id$v=19$m=..,t=..,p=..$salt[$hash]" with the given number of parts
+func parsePHC(encoded string, parts int) (KDFParams, []byte, error) {
+	var p KDFParams
+	fields := strings.Split(encoded, "$")
+	if len(fields) != parts || fields[1] != "argon2id" {
+		return p, nil, errors.New("invalid argon2id parameters")
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(fields[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return p, nil, errors.New("unsupported argon2 version")
+	}
+	if _, err := fmt.Sscanf(fields[3], "m=%d,t=%d,p=%d", &p.Memory, &p.Time, &p.Threads); err != nil {
+		return p, nil, fmt.Errorf("invalid argon2id parameters: %v", err)
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(fields[4])
+	if err != nil {
+		return p, nil, fmt.Errorf("invalid salt: %v", err)
+	}
+	p.Salt = salt
+
+	if parts == 6 {
+		hash, err := base64.RawStdEncoding.DecodeString(fields[5])
+		if err != nil {
+			return p, nil, fmt.Errorf("invalid hash: %v", err)
+		}
+		return p, hash, nil
+	}
+	return p, nil, nil
+}
+
+// legacyHashPassword hashes the password using SHA-256 21 times, the verifier of older accounts
+func legacyHashPassword(password string) string {
+	hashedPassword := []byte(password)
+	for i := 0; i < 21; i++ {
+		hash := sha256.Sum256(hashedPassword)
+		hashedPassword = hash[:]
+	}
+	return fmt.Sprintf("%x", hashedPassword)
+}
+
+// LegacyKey returns the unsalted SHA-256 key older accounts encrypted their secrets with
+func LegacyKey(password string) []byte {
+	hash := sha256.Sum256([]byte(password))
+	return hash[:]
+}
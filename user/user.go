@@ -4,7 +4,6 @@ import (
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/rand"
-	"crypto/sha256"
 	"fmt"
 	"io"
 	"sote/tor"
@@ -14,26 +13,57 @@ import (
 
 // User struct to hold user information
 type User struct {
-	Username      string
-	Password      string
-	PrivateKey    []byte
-	PublicKey     []byte
-	OnionAddress  string
-	TorrcFilePath string
-	RawPassword   string
+	// ID is the account's row in the user table, its contacts and messages reference it
+	ID int `json:"-"`
+	Profile
+	Secrets `json:"-"`
 }
 
-// Contact struct to hold contact information
+// Profile is the public part of a user, the only part the client receives
+type Profile struct {
+	Username     string
+	OnionAddress string
+	PublicKey    []byte
+}
+
+// Secrets is the part of a user that never leaves the node
+type Secrets struct {
+	Password        string
+	PrivateKey      []byte
+	OnionPrivateKey []byte
+	TorrcFilePath   string
+	KDFParams       string
+	// EncryptionKey is derived from the password with KDFParams
+	EncryptionKey []byte
+	// KeyRing holds the unlocked private key while the user is logged in
+	KeyRing *crypto.KeyRing
+}
+
+// Contact struct to hold contact information.
+// A contact is identified by the fingerprint of its key together with its onion address,
+// Username is only the name they chose for themselves.
 type Contact struct {
+	ID           int
 	Username     string
 	OnionAddress string
 	PublicKey    []byte
+	Fingerprint  string
+	// Nickname is the owner's own name for the contact, unique among their contacts
+	Nickname string
 }
 
 // CreateUser creates a new user with a username and password
 func CreateUser(username, password string) (*User, error) {
-	// Hash the password
-	hashedPassword := HashPassword(password)
+	// Hash the password for login and derive a separate key that encrypts the account's secrets
+	hashedPassword, err := HashPassword(password)
+	if err != nil {
+		return nil, err
+	}
+	kdfParams, err := NewKDFParams()
+	if err != nil {
+		return nil, err
+	}
+	encryptionKey := DeriveKey(password, kdfParams)
 
 	// Generate GPG keys
 	keyRing, err := crypto.GenerateKey(username, "", "rsa", 2048)
@@ -53,34 +83,52 @@ func CreateUser(username, password string) (*User, error) {
 	}
 
 	// Encrypt the private key with AES256
-	encryptedPrivateKey, err := EncryptAES256([]byte(privateKey), password)
+	encryptedPrivateKey, err := EncryptAES256([]byte(privateKey), encryptionKey)
 	if err != nil {
 		fmt.Println("Error encrypting private key:", err) // Debug print
 		return nil, err
 	}
 
-	// Generate .onion address and get the torrc file path
-	onionAddress, torrcFilePath, err := tor.GenerateOnionAddress()
+	// Generate the onion service key, the node adds the service through tor's control port
+	onionAddress, onionKey, err := tor.GenerateOnionKey()
 	if err != nil {
 		fmt.Println("Error generating .onion address:", err) // Debug print
 		return nil, err
 	}
 
+	// Encrypt the onion key with AES256 like the private key
+	encryptedOnionKey, err := EncryptAES256([]byte(onionKey), encryptionKey)
+	if err != nil {
+		fmt.Println("Error encrypting onion key:", err) // Debug print
+		return nil, err
+	}
+
+	torrcFilePath, err := tor.CreateTorDir()
+	if err != nil {
+		fmt.Println("Error creating tor directory:", err) // Debug print
+		return nil, err
+	}
+
 	user := &User{
-		Username:      username,
-		Password:      hashedPassword,
-		PrivateKey:    encryptedPrivateKey,
-		PublicKey:     []byte(publicKey),
-		OnionAddress:  onionAddress,
-		TorrcFilePath: torrcFilePath,
-		RawPassword:   password,
+		Profile: Profile{
+			Username:     username,
+			OnionAddress: onionAddress,
+			PublicKey:    []byte(publicKey),
+		},
+		Secrets: Secrets{
+			Password:        hashedPassword,
+			PrivateKey:      encryptedPrivateKey,
+			OnionPrivateKey: encryptedOnionKey,
+			TorrcFilePath:   torrcFilePath,
+			KDFParams:       kdfParams.String(),
+			EncryptionKey:   encryptionKey,
+		},
 	}
 	return user, nil
 }
 
-// encryptAES256 encrypts data using AES256
-func EncryptAES256(data []byte, passphrase string) ([]byte, error) {
-	key := createHash(passphrase)
+// EncryptAES256 encrypts data using AES256-GCM with a key from DeriveKey
+func EncryptAES256(data []byte, key []byte) ([]byte, error) {
 	block, err := aes.NewCipher(key)
 	if err != nil {
 		return nil, err
@@ -97,67 +145,132 @@ func EncryptAES256(data []byte, passphrase string) ([]byte, error) {
 	return ciphertext, nil
 }
 
-// createHash creates a SHA256 hash of the passphrase and returns a 32-byte key
-func createHash(passphrase string) []byte {
-	hash := sha256.Sum256([]byte(passphrase))
-	return hash[:]
+// EncryptMessage encrypts a message to the receiver's public key and signs it with the sender's key ring
+func EncryptMessage(message []byte, publicKey []byte, signer *crypto.KeyRing) ([]byte, error) {
+	return EncryptMessageToAll(message, [][]byte{publicKey}, signer)
 }
 
-// HashPassword hashes the password using SHA-256 21 times
-func HashPassword(password string) string {
-	hashedPassword := []byte(password)
-	for i := 0; i < 21; i++ {
-		hash := sha256.Sum256(hashedPassword)
-		hashedPassword = hash[:]
+// EncryptMessageToAll encrypts a message once so every one of the public keys can read it,
+// and signs it with the sender's key ring
+func EncryptMessageToAll(message []byte, publicKeys [][]byte, signer *crypto.KeyRing) ([]byte, error) {
+	keyRingObj, err := crypto.NewKeyRing(nil)
+	if err != nil {
+		return nil, fmt.Errorf("error creating key ring: %v", err)
+	}
+	for _, publicKey := range publicKeys {
+		key, err := crypto.NewKeyFromArmored(string(publicKey))
+		if err != nil {
+			return nil, fmt.Errorf("error creating key from armored public key: %v", err)
+		}
+		if err := keyRingObj.AddKey(key); err != nil {
+			return nil, fmt.Errorf("error adding key to key ring: %v", err)
+		}
+	}
+	plainMessage := crypto.NewPlainMessage(message)
+	encryptedMessage, err := keyRingObj.Encrypt(plainMessage, signer)
+	if err != nil {
+		return nil, fmt.Errorf("error encrypting message: %v", err)
 	}
-	return fmt.Sprintf("%x", hashedPassword)
+	encryptedData, _ := encryptedMessage.GetArmored()
+	return []byte(encryptedData), nil
 }
 
-func EncryptMessage(message []byte, publicKey []byte) ([]byte, error) {
-	keyRing, err := crypto.NewKeyFromArmored(string(publicKey))
+// Fingerprint returns the hex fingerprint of an armored public key
+func Fingerprint(publicKey []byte) (string, error) {
+	key, err := crypto.NewKeyFromArmored(string(publicKey))
+	if err != nil {
+		return "", fmt.Errorf("error creating key from armored public key: %v", err)
+	}
+	return key.GetFingerprint(), nil
+}
+
+// publicKeyRing creates a key ring from an armored public key
+func publicKeyRing(publicKey []byte) (*crypto.KeyRing, error) {
+	key, err := crypto.NewKeyFromArmored(string(publicKey))
 	if err != nil {
 		return nil, fmt.Errorf("error creating key from armored public key: %v", err)
 	}
-	keyRingObj, err := crypto.NewKeyRing(keyRing)
+	keyRing, err := crypto.NewKeyRing(key)
 	if err != nil {
 		return nil, fmt.Errorf("error creating key ring: %v", err)
 	}
-	plainMessage := crypto.NewPlainMessage(message)
-	encryptedMessage, err := keyRingObj.Encrypt(plainMessage, nil)
+	return keyRing, nil
+}
+
+// SignDetached signs data with a key ring and returns the binary signature
+func SignDetached(keyRing *crypto.KeyRing, data []byte) ([]byte, error) {
+	signature, err := keyRing.SignDetached(crypto.NewPlainMessage(data))
 	if err != nil {
-		return nil, fmt.Errorf("error encrypting message: %v", err)
+		return nil, fmt.Errorf("error signing data: %v", err)
 	}
-	encryptedData, _ := encryptedMessage.GetArmored()
-	return []byte(encryptedData), nil
+	return signature.GetBinary(), nil
 }
 
-func DecryptMessage(encryptedMessage []byte, privateKey []byte, passphrase string) (string, error) {
+// VerifyDetached checks a signature made by SignDetached against an armored public key
+func VerifyDetached(publicKey []byte, data []byte, signature []byte) error {
+	keyRing, err := publicKeyRing(publicKey)
+	if err != nil {
+		return err
+	}
+	return keyRing.VerifyDetached(crypto.NewPlainMessage(data), crypto.NewPGPSignature(signature), crypto.GetUnixTime())
+}
+
+// UnlockKeyRing decrypts the private key with the user's encryption key
+func UnlockKeyRing(privateKey []byte, encryptionKey []byte) (*crypto.KeyRing, error) {
 	// Decrypt the private key using AES256
-	decryptedPrivateKey, err := DecryptAES256(privateKey, passphrase)
+	decryptedPrivateKey, err := DecryptAES256(privateKey, encryptionKey)
 	if err != nil {
-		return "", fmt.Errorf("error decrypting private key: %v", err)
+		return nil, fmt.Errorf("error decrypting private key: %v", err)
 	}
 
 	// Create a key from the decrypted private key
 	key, err := crypto.NewKeyFromArmored(string(decryptedPrivateKey))
 	if err != nil {
-		return "", fmt.Errorf("error creating key from armored key: %v", err)
+		return nil, fmt.Errorf("error creating key from armored key: %v", err)
 	}
 
 	// Create a key ring from the key
 	keyRing, err := crypto.NewKeyRing(key)
 	if err != nil {
-		return "", fmt.Errorf("error creating key ring: %v", err)
+		return nil, fmt.Errorf("error creating key ring: %v", err)
+	}
+	return keyRing, nil
+}
+
+// Lock clears the unlocked key material of a user that logged out
+func (s *Secrets) Lock() {
+	if s.KeyRing != nil {
+		s.KeyRing.ClearPrivateParams()
+		s.KeyRing = nil
 	}
+	for i := range s.EncryptionKey {
+		s.EncryptionKey[i] = 0
+	}
+	s.EncryptionKey = nil
+}
+
+// DecryptMessage decrypts a message with the receiver's key ring.
+// If senderPublicKey is set, the message must carry a valid signature of that key.
+func DecryptMessage(encryptedMessage []byte, keyRing *crypto.KeyRing, senderPublicKey []byte) (string, error) {
 	// Create a PGPMessage from the encrypted message
-	message, _ := crypto.NewPGPMessageFromArmored(string(encryptedMessage))
-	if message == nil {
+	message, err := crypto.NewPGPMessageFromArmored(string(encryptedMessage))
+	if err != nil {
 		fmt.Println("Error creating PGPMessage", err)
 		return "", err
 	}
 
-	// Decrypt the message
-	decryptedMessage, err := keyRing.Decrypt(message, nil, 0)
+	var verifyKey *crypto.KeyRing
+	var verifyTime int64
+	if senderPublicKey != nil {
+		verifyKey, err = publicKeyRing(senderPublicKey)
+		if err != nil {
+			return "", err
+		}
+		verifyTime = crypto.GetUnixTime()
+	}
+
+	// Decrypt the message and verify its signature
+	decryptedMessage, err := keyRing.Decrypt(message, verifyKey, verifyTime)
 	if err != nil {
 		fmt.Println("error decrypting message", err)
 		return "",
@@ -167,8 +280,8 @@ func DecryptMessage(encryptedMessage []byte, privateKey []byte, passphrase strin
 	return string(decryptedMessage.GetBinary()), nil
 }
 
-func DecryptAES256(data []byte, passphrase string) ([]byte, error) {
-	key := createHash(passphrase)
+// DecryptAES256 decrypts data encrypted by EncryptAES256
+func DecryptAES256(data []byte, key []byte) ([]byte, error) {
 	block, err := aes.NewCipher(key)
 	if err != nil {
 		return nil, err